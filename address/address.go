@@ -0,0 +1,99 @@
+// Package address validates and normalises UK postal addresses.
+package address
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidPostCode = errors.New("invalid UK postcode")
+
+// The outward code is one of A9, A99, AA9, AA99, A9A or AA9A; the inward
+// code is a digit followed by two letters. Letters that are never used in
+// a given position are excluded, as in the Royal Mail specification.
+var postCodePattern = regexp.MustCompile(`^(` +
+	`[A-PR-UWYZ][0-9]{1,2}|` +
+	`[A-PR-UWYZ][A-HK-Y][0-9]{1,2}|` +
+	`[A-PR-UWYZ][0-9][A-HJKPSTUW]|` +
+	`[A-PR-UWYZ][A-HK-Y][0-9][ABEHMNPRVWXY]` +
+	`)([0-9][ABD-HJLNP-UW-Z]{2})$`)
+
+// compact strips all whitespace from s and upper-cases it.
+func compact(s string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(s), ""))
+}
+
+// FormatPostCode validates a UK postcode and returns it in the standard
+// form, upper case with a single space before the inward code:
+// "g49ad" becomes "G4 9AD".
+func FormatPostCode(s string) (string, error) {
+	pc := compact(s)
+	if pc == "GIR0AA" {
+		return "GIR 0AA", nil
+	}
+
+	m := postCodePattern.FindStringSubmatch(pc)
+	if m == nil {
+		return "", ErrInvalidPostCode
+	}
+	return m[1] + " " + m[2], nil
+}
+
+// ValidPostCode reports whether s is a well-formed UK postcode.
+func ValidPostCode(s string) bool {
+	_, err := FormatPostCode(s)
+	return err == nil
+}
+
+// CompactPostCode returns s upper case with no spaces, for comparing
+// postcodes whether or not they are valid.
+func CompactPostCode(s string) string {
+	return compact(s)
+}
+
+var spaceBeforePunct = regexp.MustCompile(`\s+([,.])`)
+
+// NormaliseLine tidies one address line: surrounding whitespace and
+// trailing commas are removed, runs of spaces collapsed and commas spaced
+// consistently. Lines typed entirely in upper or lower case are converted
+// to title case; mixed-case lines are assumed to be deliberate ("McLeod",
+// "2/1") and keep their capitalisation.
+func NormaliseLine(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	s = spaceBeforePunct.ReplaceAllString(s, "$1")
+	s = strings.ReplaceAll(s, ",", ", ")
+	s = strings.Join(strings.Fields(s), " ")
+	s = strings.TrimRight(s, ", ")
+
+	if s == strings.ToUpper(s) || s == strings.ToLower(s) {
+		s = titleCase(s)
+	}
+	return s
+}
+
+// titleCase upper-cases the first letter of each word and lower-cases the
+// rest. Words containing digits, such as flat positions and house numbers
+// ("2/1", "14a"), are left alone apart from lower-casing.
+func titleCase(s string) string {
+	words := strings.Split(s, " ")
+	for i, word := range words {
+		runes := []rune(strings.ToLower(word))
+		if len(runes) == 0 || strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			words[i] = string(runes)
+			continue
+		}
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Key reduces an address line to lower-case letters and digits separated by
+// single spaces, for matching addresses regardless of how they were typed.
+func Key(line string) string {
+	return strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(line), " "), " ")
+}
@@ -0,0 +1,117 @@
+// addresses.go
+
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/address"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// normaliseAddressFields formats the postcode and tidies the address lines
+// in place. An empty postcode is allowed; a malformed one is an error.
+func normaliseAddressFields(postCode *string, lines ...*string) error {
+	for _, line := range lines {
+		*line = address.NormaliseLine(*line)
+	}
+
+	if *postCode == "" {
+		return nil
+	}
+	formatted, err := address.FormatPostCode(*postCode)
+	if err != nil {
+		return err
+	}
+	*postCode = formatted
+	return nil
+}
+
+func normaliseJobAddress(job *Job) error {
+	return normaliseAddressFields(&job.PostCode,
+		&job.Address, &job.AddressLineOne, &job.AddressLineTwo, &job.AddressLineThree)
+}
+
+// AddressNormalisationResult summarises a run of normaliseAllAddresses.
+type AddressNormalisationResult struct {
+	Updated         int `json:"updated"`
+	InvalidPostCode int `json:"invalidPostCode"`
+}
+
+// normaliseAllAddresses rewrites the address fields of every job, drawing,
+// customer and property. Documents with a postcode that cannot be parsed
+// keep it as entered and are logged so they can be fixed by hand.
+func normaliseAllAddresses() (AddressNormalisationResult, error) {
+	var result AddressNormalisationResult
+
+	fields := []string{"address", "addressLineOne", "addressLineTwo", "addressLineThree"}
+	targets := []struct {
+		collection *mongo.Collection
+		postCode   string
+		synced     bool
+	}{
+		{jobCollection, "postCode", true},
+		{drawingCollection, "postCode", true},
+		{customerCollection, "postCode", false},
+		{propertyCollection, "postCode", false},
+	}
+
+	for _, target := range targets {
+		cursor, err := target.collection.Find(context.Background(), bson.M{})
+		if err != nil {
+			return result, err
+		}
+
+		for cursor.Next(context.Background()) {
+			var doc bson.M
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(context.Background())
+				return result, err
+			}
+
+			set := bson.M{}
+			for _, field := range fields {
+				value, ok := doc[field].(string)
+				if !ok {
+					continue
+				}
+				if normalised := address.NormaliseLine(value); normalised != value {
+					set[field] = normalised
+				}
+			}
+
+			if value, ok := doc[target.postCode].(string); ok && value != "" {
+				formatted, err := address.FormatPostCode(value)
+				if err != nil {
+					log.Printf("%s %v: invalid postcode %q\n", target.collection.Name(), doc["_id"], value)
+					result.InvalidPostCode++
+				} else if formatted != value {
+					set[target.postCode] = formatted
+				}
+			}
+
+			if len(set) == 0 {
+				continue
+			}
+			update := bson.M{"$set": set}
+			if target.synced {
+				update = revised(set)
+			}
+			_, err := target.collection.UpdateOne(context.Background(), bson.M{"_id": doc["_id"]}, update)
+			if err != nil {
+				cursor.Close(context.Background())
+				return result, err
+			}
+			result.Updated++
+		}
+
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,256 @@
+// audit.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AuditEntry struct {
+	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Timestamp  time.Time          `json:"timestamp" bson:"timestamp"`
+	User       string             `json:"user" bson:"user"`
+	UserID     string             `json:"userId" bson:"userId"`
+	Method     string             `json:"method" bson:"method"`
+	Route      string             `json:"route" bson:"route"`
+	Path       string             `json:"path" bson:"path"`
+	Status     int                `json:"status" bson:"status"`
+	Collection string             `json:"collection,omitempty" bson:"collection,omitempty"`
+	TargetID   string             `json:"targetId,omitempty" bson:"targetId,omitempty"`
+	Before     bson.M             `json:"before,omitempty" bson:"before,omitempty"`
+	After      bson.M             `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// auditedCollection maps the resource segment of an /api path to the
+// collection its documents live in, so the middleware can snapshot them.
+func auditedCollection(resource string) *mongo.Collection {
+	switch resource {
+	case "jobs":
+		return jobCollection
+	case "drawings":
+		return drawingCollection
+	case "customers":
+		return customerCollection
+	case "properties":
+		return propertyCollection
+	case "schedule":
+		return scheduleCollection
+	case "costs":
+		return costCollection
+	case "photos":
+		return photoCollection
+	case "webhooks":
+		return webhookCollection
+	}
+	return nil
+}
+
+// auditTarget works out which document a request acts on from its path: the
+// first ObjectID segment is the target and the segment before it names the
+// collection, e.g. /api/trash/jobs/<id>/restore -> jobs, <id>.
+func auditTarget(path string) (string, string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		if primitive.IsValidObjectID(segments[i]) {
+			return segments[i-1], segments[i]
+		}
+	}
+	if len(segments) > 1 {
+		return segments[len(segments)-1], ""
+	}
+	return "", ""
+}
+
+// auditProjection leaves fields out of snapshots that must not be kept in
+// the audit log, such as webhook secrets.
+func auditProjection(collection *mongo.Collection) bson.M {
+	if collection == webhookCollection {
+		return bson.M{"secret": 0}
+	}
+	return nil
+}
+
+func auditSnapshot(collection *mongo.Collection, id string) bson.M {
+	if collection == nil || id == "" {
+		return nil
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil
+	}
+
+	opts := options.FindOne()
+	if projection := auditProjection(collection); projection != nil {
+		opts.SetProjection(projection)
+	}
+
+	var snapshot bson.M
+	if err := collection.FindOne(context.Background(), bson.M{"_id": objID}, opts).Decode(&snapshot); err != nil {
+		return nil
+	}
+	return snapshot
+}
+
+// auditedKey marks a request whose handler has written its own entries.
+const auditedKey = "audited"
+
+// auditLog records every successful mutating request under /api in the
+// audit_log collection, with snapshots of the target document taken before
+// and after the handler runs.
+func auditLog(c *fiber.Ctx) error {
+	method := c.Method()
+	path := c.Path()
+	if !strings.HasPrefix(path, "/api/") || path == "/api/login" {
+		return c.Next()
+	}
+	if method != fiber.MethodPost && method != fiber.MethodPut &&
+		method != fiber.MethodPatch && method != fiber.MethodDelete {
+		return c.Next()
+	}
+
+	resource, targetID := auditTarget(path)
+	collection := auditedCollection(resource)
+	before := auditSnapshot(collection, targetID)
+
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	status := c.Response().StatusCode()
+	if status >= fiber.StatusBadRequest {
+		return nil
+	}
+	// A retry answered from the idempotency cache changed nothing; the
+	// original request was audited when it ran.
+	if len(c.Response().Header.Peek("Idempotent-Replayed")) > 0 {
+		return nil
+	}
+	// Handlers that audit each document they change, such as sync, have
+	// already written better entries than this one.
+	if audited, _ := c.Locals(auditedKey).(bool); audited {
+		return nil
+	}
+
+	// Creates carry the new document's ID in the response body.
+	if targetID == "" {
+		var created struct {
+			ID string `json:"_id"`
+		}
+		if json.Unmarshal(c.Response().Body(), &created) == nil {
+			targetID = created.ID
+		}
+	}
+
+	recordAudit(c, status, collection, targetID, before)
+	return nil
+}
+
+// recordAudit writes one audit entry for the current request, snapshotting
+// the target document as it is now. Handlers that change several documents
+// in one request, such as sync, call it once per document.
+func recordAudit(c *fiber.Ctx, status int, collection *mongo.Collection, targetID string, before bson.M) {
+	c.Locals(auditedKey, true)
+	entry := AuditEntry{
+		Timestamp: time.Now(),
+		Method:    c.Method(),
+		Route:     c.Route().Path,
+		Path:      c.Path(),
+		Status:    status,
+		TargetID:  targetID,
+		Before:    before,
+		After:     auditSnapshot(collection, targetID),
+	}
+	if collection != nil {
+		entry.Collection = collection.Name()
+	}
+	if claims := currentClaims(c); claims != nil {
+		entry.User = claims.Email
+		entry.UserID = claims.Subject
+	}
+
+	if _, err := auditCollection.InsertOne(context.Background(), entry); err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
+
+// parseDateParam accepts either an RFC 3339 timestamp or a plain date.
+func parseDateParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func getAuditLog(c *fiber.Ctx) error {
+	filter := bson.M{}
+	for param, field := range map[string]string{
+		"user":       "user",
+		"method":     "method",
+		"collection": "collection",
+		"targetId":   "targetId",
+		"route":      "route",
+	} {
+		if value := c.Query(param); value != "" {
+			filter[field] = value
+		}
+	}
+
+	timestamp := bson.M{}
+	if from := c.Query("from"); from != "" {
+		t, err := parseDateParam(from)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from date",
+			})
+		}
+		timestamp["$gte"] = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseDateParam(to)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to date",
+			})
+		}
+		timestamp["$lt"] = t
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Limit must be between 1 and 1000",
+		})
+	}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1}).SetLimit(int64(limit))
+	cursor, err := auditCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	entries := []AuditEntry{}
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding audit data",
+		})
+	}
+
+	return c.JSON(entries)
+}
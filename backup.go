@@ -0,0 +1,475 @@
+// backup.go
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/blob"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A backup is a zip archive holding manifest.json and one <collection>.bson
+// file per collection. Each .bson file is the collection's documents as
+// consecutive raw BSON, the same layout mongodump uses, so a single
+// document is never held in memory as more than its own bytes.
+//
+// Since version 2 the images temps and photos refer to are stored too, as
+// blobs/<key>, and the GridFS bucket's own collections are left out. A
+// restore puts them into whichever blob store is configured, so an archive
+// taken with BLOB_STORE=local or s3 is complete, and one can be restored
+// into a different kind of store than it was taken from.
+
+const (
+	backupFormat  = "preservation-windows-backup"
+	backupVersion = 2
+
+	blobArchivePrefix = "blobs/"
+)
+
+type BackupManifest struct {
+	Format      string           `json:"format"`
+	Version     int              `json:"version"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	Database    string           `json:"database"`
+	Collections map[string]int64 `json:"collections"`
+	Blobs       int64            `json:"blobs,omitempty"`
+}
+
+func backupCollectionNames() ([]string, error) {
+	names, err := database.ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var collections []string
+	for _, name := range names {
+		// The GridFS blob store's files are archived as blobs instead
+		if !strings.HasPrefix(name, "system.") && !strings.HasPrefix(name, "blobs.") {
+			collections = append(collections, name)
+		}
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// backupBlobKeys returns the key of every blob a temp or photo refers to,
+// variants included. Copied photos share their blob, so each key is given
+// once.
+func backupBlobKeys() ([]string, error) {
+	seen := map[string]bool{}
+	var keys []string
+	for _, collection := range []*mongo.Collection{tempsCollection, photoCollection} {
+		cursor, err := collection.Find(context.Background(),
+			bson.M{"blobKey": bson.M{"$nin": bson.A{nil, ""}}},
+			options.Find().SetProjection(bson.M{"blobKey": 1, "variants": 1}))
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next(context.Background()) {
+			var doc struct {
+				BlobKey  string   `bson:"blobKey"`
+				Variants []string `bson:"variants"`
+			}
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(context.Background())
+				return nil, err
+			}
+			docKeys := []string{doc.BlobKey}
+			for _, size := range doc.Variants {
+				docKeys = append(docKeys, variantKey(doc.BlobKey, size))
+			}
+			for _, key := range docKeys {
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// writeBackupBlobs copies the blobs temps and photos refer to into the
+// archive and returns how many it wrote. A blob that is already missing
+// from the store is logged and left out rather than failing the backup.
+func writeBackupBlobs(archive *zip.Writer) (int64, error) {
+	keys, err := backupBlobKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, key := range keys {
+		r, _, err := blobs.Open(context.Background(), key)
+		if err == blob.ErrNotFound {
+			log.Printf("Backup: blob %s is missing from the store, skipping", key)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("blob %s: %w", key, err)
+		}
+
+		// Images are already compressed
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:   blobArchivePrefix + key,
+			Method: zip.Store,
+		})
+		if err == nil {
+			_, err = io.Copy(f, r)
+		}
+		r.Close()
+		if err != nil {
+			return 0, fmt.Errorf("blob %s: %w", key, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// writeBackup writes every collection in the database, and the blobs its
+// temps and photos refer to, to w.
+func writeBackup(w io.Writer) (*BackupManifest, error) {
+	names, err := backupCollectionNames()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		Format:      backupFormat,
+		Version:     backupVersion,
+		CreatedAt:   time.Now().UTC(),
+		Database:    database.Name(),
+		Collections: map[string]int64{},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, name := range names {
+		f, err := archive.Create(name + ".bson")
+		if err != nil {
+			return nil, err
+		}
+
+		cursor, err := database.Collection(name).Find(context.Background(), bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		var count int64
+		for cursor.Next(context.Background()) {
+			if _, err := f.Write(cursor.Current); err != nil {
+				cursor.Close(context.Background())
+				return nil, err
+			}
+			count++
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		manifest.Collections[name] = count
+	}
+
+	if manifest.Blobs, err = writeBackupBlobs(archive); err != nil {
+		return nil, err
+	}
+
+	f, err := archive.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, archive.Close()
+}
+
+// readBSONDocuments calls fn with each raw document in r.
+func readBSONDocuments(r io.Reader, fn func(bson.Raw) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(reader, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		length := binary.LittleEndian.Uint32(size[:])
+		if length < 5 || length > 16*1024*1024 {
+			return fmt.Errorf("invalid document length %d", length)
+		}
+
+		doc := make([]byte, length)
+		copy(doc, size[:])
+		if _, err := io.ReadFull(reader, doc[4:]); err != nil {
+			return err
+		}
+		if err := bson.Raw(doc).Validate(); err != nil {
+			return err
+		}
+		if err := fn(bson.Raw(doc)); err != nil {
+			return err
+		}
+	}
+}
+
+// openBackup opens an archive and checks its manifest, that every
+// collection it lists is present with the expected number of valid
+// documents, and that it holds as many blobs as the manifest says.
+func openBackup(path string) (*zip.ReadCloser, *BackupManifest, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := map[string]*zip.File{}
+	var blobCount int64
+	for _, f := range archive.File {
+		files[f.Name] = f
+		if strings.HasPrefix(f.Name, blobArchivePrefix) {
+			blobCount++
+		}
+	}
+
+	fail := func(err error) (*zip.ReadCloser, *BackupManifest, error) {
+		archive.Close()
+		return nil, nil, err
+	}
+
+	manifestFile, ok := files["manifest.json"]
+	if !ok {
+		return fail(errors.New("archive has no manifest.json"))
+	}
+	r, err := manifestFile.Open()
+	if err != nil {
+		return fail(err)
+	}
+	var manifest BackupManifest
+	err = json.NewDecoder(r).Decode(&manifest)
+	r.Close()
+	if err != nil {
+		return fail(fmt.Errorf("invalid manifest: %w", err))
+	}
+
+	if manifest.Format != backupFormat {
+		return fail(fmt.Errorf("not a backup archive (format %q)", manifest.Format))
+	}
+	if manifest.Version < 1 || manifest.Version > backupVersion {
+		return fail(fmt.Errorf("unsupported backup version %d", manifest.Version))
+	}
+
+	for name, expected := range manifest.Collections {
+		f, ok := files[name+".bson"]
+		if !ok {
+			return fail(fmt.Errorf("archive is missing %s.bson", name))
+		}
+		r, err := f.Open()
+		if err != nil {
+			return fail(err)
+		}
+		var count int64
+		err = readBSONDocuments(r, func(bson.Raw) error {
+			count++
+			return nil
+		})
+		r.Close()
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", name, err))
+		}
+		if count != expected {
+			return fail(fmt.Errorf("%s: expected %d documents, found %d", name, expected, count))
+		}
+	}
+	if blobCount != manifest.Blobs {
+		return fail(fmt.Errorf("expected %d blobs, found %d", manifest.Blobs, blobCount))
+	}
+
+	return archive, &manifest, nil
+}
+
+// restoreBackup replaces the collections in the archive with its contents
+// and puts its blobs into the blob store, replacing any under the same
+// keys. Unless force is set it refuses to touch a collection that has
+// data.
+func restoreBackup(archive *zip.ReadCloser, manifest *BackupManifest, force bool) error {
+	names := make([]string, 0, len(manifest.Collections))
+	for name := range manifest.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if !force {
+		for _, name := range names {
+			count, err := database.Collection(name).EstimatedDocumentCount(context.Background())
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return fmt.Errorf("collection %s is not empty; use -force to replace it", name)
+			}
+		}
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	for _, name := range names {
+		collection := database.Collection(name)
+		if err := collection.Drop(context.Background()); err != nil {
+			return err
+		}
+
+		r, err := files[name+".bson"].Open()
+		if err != nil {
+			return err
+		}
+
+		var batch []interface{}
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			_, err := collection.InsertMany(context.Background(), batch)
+			batch = batch[:0]
+			return err
+		}
+		err = readBSONDocuments(r, func(doc bson.Raw) error {
+			batch = append(batch, doc)
+			if len(batch) == 500 {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	for _, f := range archive.File {
+		key := strings.TrimPrefix(f.Name, blobArchivePrefix)
+		if key == f.Name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = blobs.Put(context.Background(), key, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("blob %s: %w", key, err)
+		}
+	}
+
+	if err := resetCounters(); err != nil {
+		return err
+	}
+	if err := ensureIndexes(); err != nil {
+		return err
+	}
+
+	// The archive's data is only as migrated as its own migrations
+	// collection says; one taken before migrations existed has none.
+	if _, ok := manifest.Collections[migrationCollection.Name()]; !ok {
+		if err := migrationCollection.Drop(context.Background()); err != nil {
+			return err
+		}
+	}
+	_, err := runMigrations()
+	return err
+}
+
+// runBackup implements "backup [-o file]".
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "archive to write (default quote_db-<timestamp>.zip)")
+	flags.Parse(args)
+
+	path := *output
+	if path == "" {
+		path = fmt.Sprintf("%s-%s.zip", database.Name(), time.Now().Format("20060102-150405"))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := writeBackup(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	for name, count := range manifest.Collections {
+		fmt.Printf("%-20s %d documents\n", name, count)
+	}
+	fmt.Printf("%-20s %d files\n", "blobs", manifest.Blobs)
+	fmt.Println("Backup written to", path)
+	return nil
+}
+
+// runRestore implements "restore [-force] [-check] file".
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "replace collections that already have data")
+	check := flags.Bool("check", false, "only validate the archive")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [-force] [-check] <archive>")
+	}
+
+	archive, manifest, err := openBackup(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	fmt.Printf("Backup of %s taken %s (version %d)\n",
+		manifest.Database, manifest.CreatedAt.Format(time.RFC3339), manifest.Version)
+	if *check {
+		fmt.Println("Archive is valid")
+		return nil
+	}
+
+	if err := restoreBackup(archive, manifest, *force); err != nil {
+		return err
+	}
+	fmt.Println("Restore complete")
+	return nil
+}
@@ -0,0 +1,56 @@
+// Package blob stores uploaded files outside the main database documents.
+// Files are addressed by a caller-chosen key such as "temps/<id>" and are
+// always streamed, never held in memory whole.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// Store is a flat key/value store for file contents.
+type Store interface {
+	// Put stores the contents of r under key, replacing any existing blob,
+	// and returns the number of bytes written.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+
+	// Open returns a reader for the blob and its size. The caller must
+	// close the reader. A missing key gives ErrNotFound.
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+
+	// Delete removes the blob. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey reports whether key is safe to use as a relative path: one or
+// more non-empty segments separated by "/", with no "." or ".." segments.
+func validKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
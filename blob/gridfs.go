@@ -0,0 +1,62 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GridFS stores blobs in a MongoDB GridFS bucket, using the key as both
+// the file ID and its filename.
+type GridFS struct {
+	bucket *gridfs.Bucket
+}
+
+// NewGridFS returns a GridFS store using the named bucket in db.
+func NewGridFS(db *mongo.Database, bucketName string) (*GridFS, error) {
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(bucketName))
+	if err != nil {
+		return nil, err
+	}
+	return &GridFS{bucket: bucket}, nil
+}
+
+// Put replaces an existing file by deleting it before uploading. GridFS
+// has no atomic overwrite, so a reader may briefly see ErrNotFound.
+func (g *GridFS) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+	if err := g.Delete(ctx, key); err != nil {
+		return 0, err
+	}
+
+	counter := &countingReader{r: r}
+	if err := g.bucket.UploadFromStreamWithID(key, key, counter); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+func (g *GridFS) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	stream, err := g.bucket.OpenDownloadStream(key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return stream, stream.GetFile().Length, nil
+}
+
+func (g *GridFS) Delete(ctx context.Context, key string) error {
+	err := g.bucket.DeleteContext(ctx, key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+// blobs.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/blob"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// openBlobStore picks the blob store from BLOB_STORE: "gridfs" (the
+// default, in the "blobs" bucket of the main database), "local" (files
+// under BLOB_DIR) or "s3" (configured by the S3_* variables).
+func openBlobStore() (blob.Store, error) {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "gridfs":
+		return blob.NewGridFS(database, "blobs")
+	case "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return blob.NewLocal(dir)
+	case "s3":
+		return blob.NewS3(blob.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+}
+
+func tempBlobKey(id primitive.ObjectID) string {
+	return "temps/" + id.Hex()
+}
+
+// insertTempVersion saves temp as the next version of its name. Two
+// uploads racing for the same version are kept apart by the unique index,
+// and the loser tries the next number.
+func insertTempVersion(temp *Temp) error {
+	opts := options.FindOne().SetSort(bson.M{"version": -1})
+	for attempt := 0; ; attempt++ {
+		var latest Temp
+		err := tempsCollection.FindOne(context.Background(), bson.M{"name": temp.Name}, opts).Decode(&latest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		temp.Version = latest.Version + 1
+
+		_, err = tempsCollection.InsertOne(context.Background(), temp)
+		if err == nil || !mongo.IsDuplicateKeyError(err) || attempt == 2 {
+			return err
+		}
+	}
+}
+
+// deleteTempVersions removes every version of name except keep.
+func deleteTempVersions(name string, keep int) error {
+	filter := bson.M{"name": name, "version": bson.M{"$ne": keep}}
+	cursor, err := tempsCollection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var temp Temp
+		if err := cursor.Decode(&temp); err != nil {
+			return err
+		}
+		if err := deleteTemp(&temp); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// deleteTemp removes a temp image's contents and then its metadata.
+func deleteTemp(temp *Temp) error {
+	if temp.BlobKey != "" {
+		if err := deleteImage(context.Background(), temp.BlobKey, temp.ImageInfo); err != nil {
+			return err
+		}
+	}
+	_, err := tempsCollection.DeleteOne(context.Background(), bson.M{"_id": temp.ID})
+	return err
+}
+
+// migrateTempsToBlobStore moves image bytes stored inline on temp
+// documents into the blob store, leaving only the metadata behind. Only
+// temps still holding their bytes are moved; one uploaded by a run that
+// stopped before unsetting its image is uploaded again under the same key,
+// which replaces the earlier copy, so it is safe to re-run.
+func migrateTempsToBlobStore() error {
+	cursor, err := tempsCollection.Find(context.Background(), bson.M{"image": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var doc struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Image []byte             `bson:"image"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		key := tempBlobKey(doc.ID)
+		size, err := blobs.Put(context.Background(), key, bytes.NewReader(doc.Image))
+		if err != nil {
+			return err
+		}
+
+		_, err = tempsCollection.UpdateOne(context.Background(),
+			bson.M{"_id": doc.ID},
+			bson.M{
+				"$set": bson.M{
+					"blobKey":   key,
+					"size":      size,
+					"createdAt": doc.ID.Timestamp(),
+				},
+				"$unset": bson.M{"image": ""},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,75 @@
+// caching.go
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Surveyors are often on poor mobile signal, so anything that does not
+// change is cached by the browser and anything that might is revalidated
+// cheaply with a 304.
+
+const staticDir = "./client/dist"
+
+const (
+	cacheImmutable  = "private, max-age=31536000, immutable"
+	cacheRevalidate = "private, no-cache"
+)
+
+// notModified sets the validators on the response and reports whether the
+// request's conditional headers show the client already has this version.
+// If-None-Match takes precedence over If-Modified-Since, as in RFC 9110.
+func notModified(c *fiber.Ctx, etag string, modified time.Time) bool {
+	c.Set(fiber.HeaderETag, etag)
+	if !modified.IsZero() {
+		c.Set(fiber.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+	}
+
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, candidate := range strings.Split(noneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since := c.Get(fiber.HeaderIfModifiedSince); since != "" && !modified.IsZero() {
+		sinceTime, err := http.ParseTime(since)
+		return err == nil && !modified.Truncate(time.Second).After(sinceTime)
+	}
+	return false
+}
+
+// serveStatic serves the client bundle. Vite names everything under
+// /assets by its content hash, so those files can be cached for good;
+// index.html and the files copied from public/ keep their names and are
+// revalidated. Compressed copies are cached next to the originals.
+func serveStatic(app *fiber.App) {
+	app.Static("/assets", staticDir+"/assets", fiber.Static{
+		Compress: true,
+		ModifyResponse: func(c *fiber.Ctx) error {
+			c.Set(fiber.HeaderCacheControl, cacheImmutable)
+			return nil
+		},
+	})
+	app.Static("/", staticDir, fiber.Static{
+		Compress: true,
+		ModifyResponse: func(c *fiber.Ctx) error {
+			c.Set(fiber.HeaderCacheControl, cacheRevalidate)
+			return nil
+		},
+	})
+}
+
+// sendIndex serves index.html for client-side routes.
+func sendIndex(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, cacheRevalidate)
+	return c.SendFile(staticDir+"/index.html", true)
+}
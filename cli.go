@@ -0,0 +1,386 @@
+// cli.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Command is a subcommand of the server binary. Every command runs after
+// the environment has been loaded and MongoDB connected.
+type Command struct {
+	Usage       string
+	Description string
+	run         func(args []string) error
+}
+
+var commands = map[string]Command{
+	"serve": {
+		Usage:       "serve",
+		Description: "start the web server (default)",
+		run:         runServe,
+	},
+	"create-admin": {
+		Usage:       "create-admin -email <email> [-username <name>] [-password <password>]",
+		Description: "create an admin user, or promote an existing one",
+		run:         runCreateAdmin,
+	},
+	"reset-password": {
+		Usage:       "reset-password -email <email> [-password <password>]",
+		Description: "set a new password for a user",
+		run:         runResetPassword,
+	},
+	"migrate": {
+		Usage:       "migrate [-status] [-unlock <version>]",
+		Description: "apply pending schema migrations",
+		run:         runMigrate,
+	},
+	"backfill": {
+		Usage:       "backfill",
+		Description: "link customers and properties, normalise addresses and reprice quotes",
+		run:         runBackfill,
+	},
+	"reindex": {
+		Usage:       "reindex [-drop]",
+		Description: "create missing indexes, optionally dropping existing ones first",
+		run:         runReindex,
+	},
+	"renumber-check": {
+		Usage:       "renumber-check [-fix]",
+		Description: "report duplicate or missing quote and drawing numbers and stale counters",
+		run:         runRenumberCheck,
+	},
+	"purge-temps": {
+		Usage:       "purge-temps [-days 30] [-dry-run]",
+		Description: "delete temporary images older than the given age",
+		run:         runPurgeTemps,
+	},
+	"normalise-addresses": {
+		Usage:       "normalise-addresses",
+		Description: "tidy address lines and postcodes on every record",
+		run:         runNormaliseAddresses,
+	},
+	"backup": {
+		Usage:       "backup [-o file]",
+		Description: "write every collection and stored image to a zip archive",
+		run:         runBackup,
+	},
+	"webhook-receive": {
+		Usage:       "webhook-receive [-addr 127.0.0.1:9000] [-secret <secret>] [-status 200]",
+		Description: "print webhook deliveries sent to a local address, checking signatures",
+		run:         runWebhookReceive,
+	},
+	"restore": {
+		Usage:       "restore [-force] [-check] <archive>",
+		Description: "load a backup archive into the database and blob store",
+		run:         runRestore,
+	},
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n        %s\n", commands[name].Usage, commands[name].Description)
+	}
+}
+
+// readPassword returns the -password flag if given, otherwise a line read
+// from stdin, so passwords need not end up in shell history.
+func readPassword(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	password = strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password is required")
+	}
+	return password, nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func runCreateAdmin(args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	email := flags.String("email", "", "email address to log in with")
+	username := flags.String("username", "", "display name (defaults to the email address)")
+	password := flags.String("password", "", "password (read from stdin if omitted)")
+	flags.Parse(args)
+
+	if *email == "" {
+		return errors.New("-email is required")
+	}
+
+	var existing User
+	err := userCollection.FindOne(context.Background(), bson.M{"email": *email}).Decode(&existing)
+	if err == nil {
+		_, err = userCollection.UpdateOne(context.Background(),
+			bson.M{"_id": existing.ID},
+			bson.M{"$set": bson.M{"role": "admin"}})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Promoted", *email, "to admin")
+		return nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	pw, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	hashed, err := hashPassword(pw)
+	if err != nil {
+		return err
+	}
+
+	user := User{
+		Username: *username,
+		Email:    *email,
+		Password: hashed,
+		Role:     "admin",
+	}
+	if user.Username == "" {
+		user.Username = *email
+	}
+	if _, err := userCollection.InsertOne(context.Background(), user); err != nil {
+		return err
+	}
+	fmt.Println("Created admin", *email)
+	return nil
+}
+
+func runResetPassword(args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	email := flags.String("email", "", "email address of the user")
+	password := flags.String("password", "", "new password (read from stdin if omitted)")
+	flags.Parse(args)
+
+	if *email == "" {
+		return errors.New("-email is required")
+	}
+
+	count, err := userCollection.CountDocuments(context.Background(), bson.M{"email": *email})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no user with email %s", *email)
+	}
+
+	pw, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	hashed, err := hashPassword(pw)
+	if err != nil {
+		return err
+	}
+
+	_, err = userCollection.UpdateOne(context.Background(),
+		bson.M{"email": *email},
+		bson.M{"$set": bson.M{"password": hashed}})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Password reset for", *email)
+	return nil
+}
+
+func runBackfill(args []string) error {
+	customers, err := linkAllCustomers()
+	if err != nil {
+		return fmt.Errorf("customers: %w", err)
+	}
+	fmt.Printf("Customers: %d jobs and %d drawings linked, %d created, %d unmatched\n",
+		customers.Jobs, customers.Drawings, customers.Created, customers.Unmatched)
+
+	properties, err := linkAllProperties()
+	if err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+	fmt.Printf("Properties: %d jobs and %d drawings linked, %d unmatched\n",
+		properties.Jobs, properties.Drawings, properties.Unmatched)
+
+	if err := runNormaliseAddresses(nil); err != nil {
+		return err
+	}
+
+	repriced, err := repriceAll()
+	if err != nil {
+		return fmt.Errorf("pricing: %w", err)
+	}
+	fmt.Printf("Repriced %d jobs\n", repriced)
+	return nil
+}
+
+func runNormaliseAddresses(args []string) error {
+	result, err := normaliseAllAddresses()
+	if err != nil {
+		return fmt.Errorf("addresses: %w", err)
+	}
+	fmt.Printf("Normalised %d documents, %d with invalid postcodes\n", result.Updated, result.InvalidPostCode)
+	return nil
+}
+
+func runReindex(args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	drop := flags.Bool("drop", false, "drop all non-_id indexes before recreating them")
+	flags.Parse(args)
+
+	if *drop {
+		for collection := range collectionIndexes() {
+			if _, err := collection.Indexes().DropAll(context.Background()); err != nil {
+				return fmt.Errorf("%s: %w", collection.Name(), err)
+			}
+			fmt.Println("Dropped indexes on", collection.Name())
+		}
+	}
+
+	if err := ensureIndexes(); err != nil {
+		return err
+	}
+	fmt.Println("Indexes up to date")
+	return nil
+}
+
+func runRenumberCheck(args []string) error {
+	flags := flag.NewFlagSet("renumber-check", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "move counters up to the highest number in use")
+	flags.Parse(args)
+
+	used, invalid, err := usedNumbers()
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, id := range invalid {
+		problems++
+		fmt.Printf("Job %s has a quote ID outside any sequence\n", id)
+	}
+
+	series := make([]string, 0, len(used))
+	for name := range used {
+		series = append(series, name)
+	}
+	sort.Strings(series)
+
+	for _, name := range series {
+		use := used[name]
+		highest := use.highest()
+
+		for n := 1; n <= highest; n++ {
+			if ids := use.Issued[n]; len(ids) > 1 {
+				problems++
+				fmt.Printf("%s %d was issued %d times: %s\n", name, n, len(ids), strings.Join(ids, ", "))
+			}
+		}
+
+		var missing []string
+		for n := 1; n < highest; n++ {
+			if !use.Seen[n] {
+				missing = append(missing, strconv.Itoa(n))
+			}
+		}
+		if len(missing) > 0 {
+			fmt.Printf("%s: %d numbers below %d are unused: %s\n", name, len(missing), highest, strings.Join(missing, ", "))
+		}
+
+		var counter Counter
+		err := countersCollection.FindOne(context.Background(), bson.M{"_id": name}).Decode(&counter)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if counter.Seq < highest {
+			problems++
+			fmt.Printf("Counter %s is at %d but %d is already in use\n", name, counter.Seq, highest)
+			if *fix {
+				if err := advanceCounter(name, highest); err != nil {
+					return err
+				}
+				fmt.Printf("Counter %s moved to %d\n", name, highest)
+			}
+		}
+	}
+
+	if problems == 0 {
+		fmt.Println("Quote and drawing numbers OK")
+	}
+	return nil
+}
+
+func runPurgeTemps(args []string) error {
+	flags := flag.NewFlagSet("purge-temps", flag.ExitOnError)
+	days := flags.Int("days", 30, "delete temporary images older than this many days")
+	dryRun := flags.Bool("dry-run", false, "only report how many would be deleted")
+	flags.Parse(args)
+
+	// Older temps carry no createdAt, so age comes from the ObjectID.
+	cutoff := primitive.NewObjectIDFromTimestamp(time.Now().AddDate(0, 0, -*days))
+	filter := bson.M{"_id": bson.M{"$lt": cutoff}}
+
+	if *dryRun {
+		count, err := tempsCollection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d temporary images older than %d days\n", count, *days)
+		return nil
+	}
+
+	cursor, err := tempsCollection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	deleted := 0
+	for cursor.Next(context.Background()) {
+		var temp Temp
+		if err := cursor.Decode(&temp); err != nil {
+			return err
+		}
+		if err := deleteTemp(&temp); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d temporary images older than %d days\n", deleted, *days)
+	return nil
+}
@@ -500,7 +500,7 @@ const calculateRoomCost = (room: Room): number => {
     .map(Number)
     .reduce((a, b) => a + b);
   let priceChange = 0;
-  if (room.priceChange2 != "0") {
+  if (room.priceChange2 && room.priceChange2 != "0") {
     priceChange = parseFloat(room.priceChange2.replace("%", ""));
   } else {
     priceChange = room.priceChange || 0;
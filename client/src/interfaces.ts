@@ -1,6 +1,7 @@
 // src/interfaces.ts
 
 export interface Room {
+    roomId?: string;
     ref: string;
     roomName: string;
     width: number;
@@ -54,6 +55,7 @@ export interface Room {
     address: string;
     email: string;
     phone: string;
+    surveyor?: string; // Email of the user the survey is assigned to
     postCode: string;
     rooms: Room[];
     options: string[];
@@ -0,0 +1,453 @@
+// costing.go
+
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Actual costs are recorded against a job or a drawing as they are incurred
+// and compared with the server-side price of the quote to give margins.
+
+const (
+	CostMaterials = "materials"
+	CostLabour    = "labour"
+)
+
+type CostEntry struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	TargetType  string             `json:"targetType" bson:"targetType"`
+	TargetID    primitive.ObjectID `json:"targetId" bson:"targetId"`
+	Category    string             `json:"category" bson:"category"`
+	Description string             `json:"description" bson:"description"`
+	Amount      float64            `json:"amount" bson:"amount"`
+	Hours       float64            `json:"hours,omitempty" bson:"hours,omitempty"`
+	Date        time.Time          `json:"date" bson:"date"`
+	CreatedBy   string             `json:"createdBy" bson:"createdBy"`
+}
+
+// Margin compares the quoted net value of a job or drawing with its
+// recorded costs.
+type Margin struct {
+	TargetType    string  `json:"targetType"`
+	TargetID      string  `json:"targetId"`
+	QuoteID       string  `json:"quoteId"`
+	CustomerName  string  `json:"customerName"`
+	Option        string  `json:"option"`
+	Month         string  `json:"month"`
+	Quoted        float64 `json:"quoted"`
+	Materials     float64 `json:"materials"`
+	Labour        float64 `json:"labour"`
+	Actual        float64 `json:"actual"`
+	Margin        float64 `json:"margin"`
+	MarginPercent float64 `json:"marginPercent"`
+}
+
+// MarginTotal is a margin summed over a group of jobs.
+type MarginTotal struct {
+	Key           string  `json:"key"`
+	Count         int     `json:"count"`
+	Quoted        float64 `json:"quoted"`
+	Actual        float64 `json:"actual"`
+	Margin        float64 `json:"margin"`
+	MarginPercent float64 `json:"marginPercent"`
+}
+
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func marginPercent(margin, quoted float64) float64 {
+	if quoted == 0 {
+		return 0
+	}
+	return math.Round(margin/quoted*1000) / 10
+}
+
+func targetCollection(targetType string) *mongo.Collection {
+	if targetType == "drawing" {
+		return drawingCollection
+	}
+	return jobCollection
+}
+
+// buildMargin prices the job for option and subtracts the given costs.
+func buildMargin(targetType string, job *Job, option string, materials, labour float64) Margin {
+	quoted := priceJob(job, option).Net
+	actual := materials + labour
+
+	month := ""
+	if len(job.Date) >= 7 {
+		month = job.Date[:7]
+	}
+
+	m := Margin{
+		TargetType:   targetType,
+		TargetID:     job.ID.Hex(),
+		QuoteID:      job.QuoteID,
+		CustomerName: job.CustomerName,
+		Option:       option,
+		Month:        month,
+		Quoted:       roundMoney(quoted),
+		Materials:    roundMoney(materials),
+		Labour:       roundMoney(labour),
+		Actual:       roundMoney(actual),
+		Margin:       roundMoney(quoted - actual),
+	}
+	m.MarginPercent = marginPercent(m.Margin, m.Quoted)
+	return m
+}
+
+func findCosts(targetType string, targetID primitive.ObjectID) ([]CostEntry, error) {
+	filter := bson.M{"targetType": targetType, "targetId": targetID}
+	opts := options.Find().SetSort(bson.M{"date": 1})
+
+	cursor, err := costCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	costs := []CostEntry{}
+	if err := cursor.All(context.Background(), &costs); err != nil {
+		return nil, err
+	}
+	return costs, nil
+}
+
+// loadTarget reads the :id param and finds the job or drawing it names.
+func loadTarget(c *fiber.Ctx, targetType string) (*Job, *fiber.Error) {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+
+	var job Job
+	err = targetCollection(targetType).FindOne(context.Background(), notDeleted(bson.M{"_id": objID})).Decode(&job)
+	if err != nil {
+		if targetType == "drawing" {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Drawing not found")
+		}
+		return nil, fiber.NewError(fiber.StatusNotFound, "Job not found")
+	}
+	return &job, nil
+}
+
+func listCosts(c *fiber.Ctx, targetType string) error {
+	job, ferr := loadTarget(c, targetType)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	costs, err := findCosts(targetType, job.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.JSON(costs)
+}
+
+func addCost(c *fiber.Ctx, targetType string) error {
+	job, ferr := loadTarget(c, targetType)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var cost CostEntry
+	if err := c.BodyParser(&cost); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	if cost.Category != CostMaterials && cost.Category != CostLabour {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Category must be materials or labour",
+		})
+	}
+	if cost.Amount < 0 || cost.Hours < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Amount and hours cannot be negative",
+		})
+	}
+
+	cost.ID = primitive.NilObjectID
+	cost.TargetType = targetType
+	cost.TargetID = job.ID
+	cost.CreatedBy = currentUserEmail(c)
+	if cost.Date.IsZero() {
+		cost.Date = time.Now()
+	}
+
+	result, err := costCollection.InsertOne(context.Background(), cost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save cost",
+		})
+	}
+
+	cost.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(cost)
+}
+
+func getMargin(c *fiber.Ctx, targetType string) error {
+	job, ferr := loadTarget(c, targetType)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	costs, err := findCosts(targetType, job.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	var materials, labour float64
+	for _, cost := range costs {
+		if cost.Category == CostLabour {
+			labour += cost.Amount
+		} else {
+			materials += cost.Amount
+		}
+	}
+
+	option := c.Query("option", quotedOption(job))
+	return c.JSON(buildMargin(targetType, job, option, materials, labour))
+}
+
+func getJobCosts(c *fiber.Ctx) error {
+	return listCosts(c, "job")
+}
+
+func addJobCost(c *fiber.Ctx) error {
+	return addCost(c, "job")
+}
+
+func getJobMargin(c *fiber.Ctx) error {
+	return getMargin(c, "job")
+}
+
+func getDrawingCosts(c *fiber.Ctx) error {
+	return listCosts(c, "drawing")
+}
+
+func addDrawingCost(c *fiber.Ctx) error {
+	return addCost(c, "drawing")
+}
+
+func getDrawingMargin(c *fiber.Ctx) error {
+	return getMargin(c, "drawing")
+}
+
+func deleteCost(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	result, err := costCollection.DeleteOne(context.Background(), bson.M{"_id": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not delete cost",
+		})
+	}
+
+	if result.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Cost not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Cost deleted"})
+}
+
+func totalMargins(margins []Margin, key func(Margin) string) []MarginTotal {
+	byKey := map[string]*MarginTotal{}
+	for _, m := range margins {
+		k := key(m)
+		total, ok := byKey[k]
+		if !ok {
+			total = &MarginTotal{Key: k}
+			byKey[k] = total
+		}
+		total.Count++
+		total.Quoted += m.Quoted
+		total.Actual += m.Actual
+	}
+
+	totals := make([]MarginTotal, 0, len(byKey))
+	for _, total := range byKey {
+		total.Quoted = roundMoney(total.Quoted)
+		total.Actual = roundMoney(total.Actual)
+		total.Margin = roundMoney(total.Quoted - total.Actual)
+		total.MarginPercent = marginPercent(total.Margin, total.Quoted)
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Key < totals[j].Key })
+	return totals
+}
+
+// getMarginReport returns the margin on every job and drawing with recorded
+// costs, with totals per option and per month (of the quote date). The
+// from and to params limit the report to quote months, as YYYY-MM.
+//
+// A drawing carries the quote number of the job it was converted from, and
+// the two are the same piece of work: they are reported once, with their
+// costs added together and priced as the drawing.
+func getMarginReport(c *fiber.Ctx) error {
+	from, to := c.Query("from"), c.Query("to")
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"targetType": "$targetType", "targetId": "$targetId"},
+			"materials": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$category", CostMaterials}}, "$amount", 0},
+			}},
+			"labour": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$category", CostLabour}}, "$amount", 0},
+			}},
+		}}},
+	}
+
+	cursor, err := costCollection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	var groups []struct {
+		ID struct {
+			TargetType string             `bson:"targetType"`
+			TargetID   primitive.ObjectID `bson:"targetId"`
+		} `bson:"_id"`
+		Materials float64 `bson:"materials"`
+		Labour    float64 `bson:"labour"`
+	}
+	if err := cursor.All(context.Background(), &groups); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding cost data",
+		})
+	}
+
+	// Load the costed jobs and drawings with one query per collection.
+	ids := map[string][]primitive.ObjectID{}
+	for _, group := range groups {
+		ids[group.ID.TargetType] = append(ids[group.ID.TargetType], group.ID.TargetID)
+	}
+	targets := map[string]Job{}
+	for targetType, targetIDs := range ids {
+		cursor, err := targetCollection(targetType).Find(context.Background(),
+			notDeleted(bson.M{"_id": bson.M{"$in": targetIDs}}))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		var jobs []Job
+		err = cursor.All(context.Background(), &jobs)
+		cursor.Close(context.Background())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Error decoding job data",
+			})
+		}
+		for _, job := range jobs {
+			targets[viewTarget(targetType, job.ID.Hex())] = job
+		}
+	}
+
+	type work struct {
+		targetType        string
+		job               Job
+		materials, labour float64
+	}
+	byQuote := map[string]*work{}
+	var order []string
+	for _, group := range groups {
+		key := viewTarget(group.ID.TargetType, group.ID.TargetID.Hex())
+		job, ok := targets[key]
+		if !ok {
+			continue
+		}
+		if job.QuoteID != "" {
+			key = job.QuoteID
+		}
+
+		w := byQuote[key]
+		if w == nil {
+			w = &work{targetType: group.ID.TargetType, job: job}
+			byQuote[key] = w
+			order = append(order, key)
+		} else if group.ID.TargetType == "drawing" {
+			w.targetType, w.job = group.ID.TargetType, job
+		}
+		w.materials += group.Materials
+		w.labour += group.Labour
+	}
+
+	margins := []Margin{}
+	for _, key := range order {
+		w := byQuote[key]
+		m := buildMargin(w.targetType, &w.job, quotedOption(&w.job), w.materials, w.labour)
+		if (from != "" && m.Month < from) || (to != "" && m.Month > to) {
+			continue
+		}
+		margins = append(margins, m)
+	}
+
+	sort.Slice(margins, func(i, j int) bool { return margins[i].Month < margins[j].Month })
+
+	return c.JSON(fiber.Map{
+		"jobs":     margins,
+		"byOption": totalMargins(margins, func(m Margin) string { return m.Option }),
+		"byMonth":  totalMargins(margins, func(m Margin) string { return m.Month }),
+	})
+}
+
+// getJobQuote returns the server-side price of a job for each of its
+// options, or for the option given in the query.
+func getJobQuote(c *fiber.Ctx) error {
+	job, ferr := loadTarget(c, "job")
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	if option := c.Query("option"); option != "" {
+		return c.JSON(priceJob(job, option))
+	}
+
+	options := job.Options
+	if len(options) == 0 {
+		options = []string{OptionRefurb}
+	}
+	quotes := make([]Quote, 0, len(options))
+	for _, option := range options {
+		quotes = append(quotes, priceJob(job, option))
+	}
+	return c.JSON(quotes)
+}
@@ -0,0 +1,455 @@
+// customers.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/address"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Customers are stored once and referenced from jobs by customerId. Jobs
+// still carry a copy of the contact details as they were when quoted.
+
+type Customer struct {
+	ID               primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	CustomerName     string             `json:"customerName" bson:"customerName"`
+	Email            string             `json:"email" bson:"email"`
+	Phone            string             `json:"phone" bson:"phone"`
+	AddressLineOne   string             `json:"addressLineOne" bson:"addressLineOne"`
+	AddressLineTwo   string             `json:"addressLineTwo" bson:"addressLineTwo"`
+	AddressLineThree string             `json:"addressLineThree" bson:"addressLineThree"`
+	PostCode         string             `json:"postCode" bson:"postCode"`
+	MatchKeys        []string           `json:"-" bson:"matchKeys"`
+}
+
+var errCustomerNotFound = errors.New("Customer not found")
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+// customerKeys returns the normalised values used to recognise the same
+// customer across jobs. Email and phone identify a customer on their own;
+// a postcode only does together with the name, since neighbours in a
+// tenement share one.
+func customerKeys(name, email, phone, postCode string) []string {
+	var keys []string
+	if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+		keys = append(keys, "email:"+email)
+	}
+	if phone = nonDigits.ReplaceAllString(phone, ""); phone != "" {
+		keys = append(keys, "phone:"+phone)
+	}
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	postCode = address.CompactPostCode(postCode)
+	if name != "" && postCode != "" {
+		keys = append(keys, "name:"+name+"|"+postCode)
+	}
+	return keys
+}
+
+func (c *Customer) keys() []string {
+	return customerKeys(c.CustomerName, c.Email, c.Phone, c.PostCode)
+}
+
+// refreshKeys must be called before a customer is written so that
+// findMatchingCustomer can query on the normalised keys.
+func (c *Customer) refreshKeys() {
+	c.MatchKeys = c.keys()
+}
+
+func (c *Customer) normaliseAddress() error {
+	return normaliseAddressFields(&c.PostCode, &c.AddressLineOne, &c.AddressLineTwo, &c.AddressLineThree)
+}
+
+func customerFromJob(job *Job) Customer {
+	return Customer{
+		CustomerName:     job.CustomerName,
+		Email:            job.Email,
+		Phone:            job.Phone,
+		AddressLineOne:   job.AddressLineOne,
+		AddressLineTwo:   job.AddressLineTwo,
+		AddressLineThree: job.AddressLineThree,
+		PostCode:         job.PostCode,
+	}
+}
+
+// findMatchingCustomer looks for an existing customer sharing an email,
+// phone number or name and postcode with the given details.
+func findMatchingCustomer(customer *Customer) (*Customer, error) {
+	keys := customer.keys()
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var existing Customer
+	err := customerCollection.FindOne(context.Background(), bson.M{"matchKeys": bson.M{"$in": keys}}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// linkJobCustomer sets job.CustomerID. A job that already names a customer
+// has its empty contact fields filled from it; otherwise the customer is
+// matched on the job's details, or created.
+func linkJobCustomer(job *Job) error {
+	if !job.CustomerID.IsZero() {
+		var customer Customer
+		err := customerCollection.FindOne(context.Background(), bson.M{"_id": job.CustomerID}).Decode(&customer)
+		if err == mongo.ErrNoDocuments {
+			return errCustomerNotFound
+		}
+		if err != nil {
+			return err
+		}
+		fillJobFromCustomer(job, &customer)
+		return nil
+	}
+
+	customer := customerFromJob(job)
+	customer.refreshKeys()
+	if len(customer.MatchKeys) == 0 {
+		return nil
+	}
+
+	existing, err := findMatchingCustomer(&customer)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		job.CustomerID = existing.ID
+		return nil
+	}
+
+	result, err := customerCollection.InsertOne(context.Background(), customer)
+	if err != nil {
+		return err
+	}
+	job.CustomerID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func fillJobFromCustomer(job *Job, customer *Customer) {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&job.CustomerName, customer.CustomerName)
+	fill(&job.Email, customer.Email)
+	fill(&job.Phone, customer.Phone)
+	fill(&job.AddressLineOne, customer.AddressLineOne)
+	fill(&job.AddressLineTwo, customer.AddressLineTwo)
+	fill(&job.AddressLineThree, customer.AddressLineThree)
+	fill(&job.PostCode, customer.PostCode)
+}
+
+func getCustomers(c *fiber.Ctx) error {
+	filter := bson.M{}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+		filter["$or"] = []bson.M{
+			{"customerName": pattern},
+			{"email": pattern},
+			{"phone": pattern},
+			{"postCode": pattern},
+		}
+	}
+
+	cursor, err := customerCollection.Find(context.Background(), filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	customers := []Customer{}
+	if err := cursor.All(context.Background(), &customers); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding customer data",
+		})
+	}
+
+	return c.JSON(customers)
+}
+
+func getCustomer(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var customer Customer
+	err = customerCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&customer)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Customer not found",
+		})
+	}
+
+	return c.JSON(customer)
+}
+
+func getCustomerJobs(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	cursor, err := jobCollection.Find(context.Background(), notDeleted(bson.M{"customerId": objID}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	jobs := []Job{}
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding job data",
+		})
+	}
+
+	return c.JSON(jobs)
+}
+
+func createCustomer(c *fiber.Ctx) error {
+	var customer Customer
+	if err := c.BodyParser(&customer); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	if customer.CustomerName == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Customer name is required",
+		})
+	}
+
+	if err := customer.normaliseAddress(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	customer.ID = primitive.NilObjectID
+	customer.refreshKeys()
+	result, err := customerCollection.InsertOne(context.Background(), customer)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create customer",
+		})
+	}
+
+	customer.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(customer)
+}
+
+func updateCustomer(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	customer := new(Customer)
+	if err := c.BodyParser(customer); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	if err := customer.normaliseAddress(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	customer.ID = primitive.NilObjectID
+	customer.refreshKeys()
+
+	result, err := customerCollection.UpdateOne(context.Background(), bson.M{"_id": objID}, bson.M{"$set": customer})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not update customer",
+		})
+	}
+
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Customer not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Customer updated"})
+}
+
+func deleteCustomer(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	// Jobs and drawings in the trash still count, as they can be restored.
+	for _, collection := range []*mongo.Collection{jobCollection, drawingCollection} {
+		count, err := collection.CountDocuments(context.Background(), bson.M{"customerId": objID})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if count > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Customer still has jobs or drawings",
+			})
+		}
+	}
+
+	result, err := customerCollection.DeleteOne(context.Background(), bson.M{"_id": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not delete customer",
+		})
+	}
+
+	if result.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Customer not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Customer deleted"})
+}
+
+// CustomerMigrationResult summarises a run of linkAllCustomers.
+type CustomerMigrationResult struct {
+	Jobs      int `json:"jobs"`
+	Drawings  int `json:"drawings"`
+	Created   int `json:"created"`
+	Unmatched int `json:"unmatched"`
+}
+
+// linkAllCustomers gives every job and drawing without a customerId a
+// customer, de-duplicating on email, phone or name and postcode. Drawings
+// are copies of jobs so they go through the same matching.
+func linkAllCustomers() (CustomerMigrationResult, error) {
+	var result CustomerMigrationResult
+
+	known := map[string]primitive.ObjectID{}
+	remember := func(id primitive.ObjectID, c *Customer) {
+		for _, key := range c.keys() {
+			if _, ok := known[key]; !ok {
+				known[key] = id
+			}
+		}
+	}
+
+	cursor, err := customerCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return result, err
+	}
+	for cursor.Next(context.Background()) {
+		var customer Customer
+		if err := cursor.Decode(&customer); err != nil {
+			cursor.Close(context.Background())
+			return result, err
+		}
+		remember(customer.ID, &customer)
+	}
+	cursor.Close(context.Background())
+
+	link := func(collection *mongo.Collection, linked *int) error {
+		filter := bson.M{"customerId": bson.M{"$exists": false}}
+		cursor, err := collection.Find(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(context.Background())
+
+		for cursor.Next(context.Background()) {
+			var job Job
+			if err := cursor.Decode(&job); err != nil {
+				return err
+			}
+
+			customer := customerFromJob(&job)
+			customer.refreshKeys()
+			if len(customer.MatchKeys) == 0 {
+				result.Unmatched++
+				continue
+			}
+
+			var customerID primitive.ObjectID
+			for _, key := range customer.MatchKeys {
+				if id, ok := known[key]; ok {
+					customerID = id
+					break
+				}
+			}
+			if customerID.IsZero() {
+				inserted, err := customerCollection.InsertOne(context.Background(), customer)
+				if err != nil {
+					return err
+				}
+				customerID = inserted.InsertedID.(primitive.ObjectID)
+				result.Created++
+			}
+			// Remember every key so later jobs can match on any of them.
+			remember(customerID, &customer)
+			_, err := customerCollection.UpdateOne(context.Background(),
+				bson.M{"_id": customerID},
+				bson.M{"$addToSet": bson.M{"matchKeys": bson.M{"$each": customer.MatchKeys}}})
+			if err != nil {
+				return err
+			}
+
+			_, err = collection.UpdateOne(context.Background(),
+				bson.M{"_id": job.ID},
+				revised(bson.M{"customerId": customerID}))
+			if err != nil {
+				return err
+			}
+			*linked++
+		}
+		return cursor.Err()
+	}
+
+	if err := link(jobCollection, &result.Jobs); err != nil {
+		return result, err
+	}
+	if err := link(drawingCollection, &result.Drawings); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func migrateCustomers(c *fiber.Ctx) error {
+	result, err := linkAllCustomers()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Customer migration failed",
+		})
+	}
+
+	return c.JSON(result)
+}
@@ -0,0 +1,260 @@
+// events.go
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Live updates are pushed to clients as server-sent events on
+// GET /api/events. The stream needs the usual Authorization header, so
+// browsers read it with fetch rather than EventSource. Every event is named
+// "<type>.<op>", e.g. "job.updated" or "room.deleted", and carries an Event
+// as its data. The first event, "hello", gives the connection's ID, which
+// the client passes to PUT /api/presence to say what it is looking at.
+
+// eventHeartbeat is how often an idle stream gets a comment line, which
+// keeps proxies from closing it and finds clients that have gone away.
+const eventHeartbeat = 20 * time.Second
+
+// eventBuffer is how many events a client may fall behind by before it is
+// dropped; it reconnects and refetches what it has open.
+const eventBuffer = 64
+
+// Event is the data of one server-sent event. Type is the kind of document
+// the event is about ("job" or "drawing"), also for room events, where Room
+// is the room's index.
+type Event struct {
+	Name    string   `json:"-"`
+	Type    string   `json:"type,omitempty"`
+	ID      string   `json:"id"`
+	Rev     int      `json:"rev,omitempty"`
+	Room    *int     `json:"room,omitempty"`
+	Viewers []Viewer `json:"viewers,omitempty"`
+}
+
+// Viewer is a user with a job or drawing open.
+type Viewer struct {
+	Email string `json:"email"`
+}
+
+type eventClient struct {
+	id      string
+	viewer  Viewer
+	viewing string // "<type>:<id>" or empty
+	events  chan Event
+}
+
+// eventHub fans events out to every connected client and keeps track of
+// who is viewing what.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[string]*eventClient
+}
+
+var events = &eventHub{clients: map[string]*eventClient{}}
+
+func (h *eventHub) subscribe(viewer Viewer) *eventClient {
+	client := &eventClient{
+		id:     primitive.NewObjectID().Hex(),
+		viewer: viewer,
+		events: make(chan Event, eventBuffer),
+	}
+	h.mu.Lock()
+	h.clients[client.id] = client
+	h.mu.Unlock()
+	return client
+}
+
+// unsubscribe removes a client whose stream has ended, whether it went
+// away or publish dropped it, and tells everyone it stopped viewing.
+func (h *eventHub) unsubscribe(client *eventClient) {
+	h.mu.Lock()
+	delete(h.clients, client.id)
+	viewing := client.viewing
+	client.viewing = ""
+	h.mu.Unlock()
+
+	if viewing != "" {
+		h.publishPresence(viewing)
+	}
+}
+
+// publish sends e to every client. A client whose buffer is full is
+// disconnected rather than allowed to hold up the rest.
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	var dropped []*eventClient
+	for _, client := range h.clients {
+		select {
+		case client.events <- e:
+		default:
+			dropped = append(dropped, client)
+		}
+	}
+	for _, client := range dropped {
+		delete(h.clients, client.id)
+		close(client.events)
+	}
+	h.mu.Unlock()
+}
+
+// viewers lists the users viewing target, each once however many
+// connections they have open on it.
+func (h *eventHub) viewers(target string) []Viewer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := map[string]bool{}
+	viewers := []Viewer{}
+	for _, client := range h.clients {
+		if client.viewing == target && !seen[client.viewer.Email] {
+			seen[client.viewer.Email] = true
+			viewers = append(viewers, client.viewer)
+		}
+	}
+	sort.Slice(viewers, func(i, j int) bool { return viewers[i].Email < viewers[j].Email })
+	return viewers
+}
+
+func (h *eventHub) publishPresence(target string) {
+	targetType, id := splitViewTarget(target)
+	h.publish(Event{Name: "presence", Type: targetType, ID: id, Viewers: h.viewers(target)})
+}
+
+func viewTarget(targetType, id string) string {
+	return targetType + ":" + id
+}
+
+func splitViewTarget(target string) (string, string) {
+	targetType, id, _ := strings.Cut(target, ":")
+	return targetType, id
+}
+
+func writeEvent(w *bufio.Writer, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, data)
+	return err
+}
+
+func streamEvents(c *fiber.Ctx) error {
+	client := events.subscribe(Viewer{Email: currentUserEmail(c)})
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer events.unsubscribe(client)
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+
+		if writeEvent(w, Event{Name: "hello", ID: client.id}) != nil || w.Flush() != nil {
+			return
+		}
+		for {
+			select {
+			case e, ok := <-client.events:
+				if !ok {
+					return
+				}
+				if err := writeEvent(w, e); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := w.WriteString(": ping\n\n"); err != nil {
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// setPresence records which job or drawing a connection has open. An
+// empty id means it has none open.
+func setPresence(c *fiber.Ctx) error {
+	var body struct {
+		Connection string `json:"connection"`
+		Type       string `json:"type"`
+		ID         string `json:"id"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	target := ""
+	if body.ID != "" {
+		if body.Type != "job" && body.Type != "drawing" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Type must be job or drawing",
+			})
+		}
+		if !primitive.IsValidObjectID(body.ID) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid ID",
+			})
+		}
+		target = viewTarget(body.Type, body.ID)
+	}
+
+	events.mu.Lock()
+	client, ok := events.clients[body.Connection]
+	if !ok || client.viewer.Email != currentUserEmail(c) {
+		events.mu.Unlock()
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Connection not found",
+		})
+	}
+	previous := client.viewing
+	client.viewing = target
+	events.mu.Unlock()
+
+	if previous != "" && previous != target {
+		events.publishPresence(previous)
+	}
+	if target == "" {
+		return c.JSON(fiber.Map{"viewers": []Viewer{}})
+	}
+	if previous != target {
+		events.publishPresence(target)
+	}
+	return c.JSON(fiber.Map{"viewers": events.viewers(target)})
+}
+
+func listViewers(c *fiber.Ctx, targetType string) error {
+	id := c.Params("id")
+	if !primitive.IsValidObjectID(id) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+	return c.JSON(events.viewers(viewTarget(targetType, id)))
+}
+
+func getJobViewers(c *fiber.Ctx) error {
+	return listViewers(c, "job")
+}
+
+func getDrawingViewers(c *fiber.Ctx) error {
+	return listViewers(c, "drawing")
+}
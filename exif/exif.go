@@ -0,0 +1,202 @@
+// Package exif reads the few EXIF tags the app needs from JPEG photos:
+// when the photo was taken and which way up the camera was held.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNoExif = errors.New("no EXIF data")
+
+// Info holds the tags read from a photo. Fields are zero when the tag is
+// absent.
+type Info struct {
+	// Taken is DateTimeOriginal, falling back to DateTime. EXIF times carry
+	// no zone unless OffsetTimeOriginal is set; without it they are read
+	// as local time.
+	Taken time.Time
+
+	// Orientation is the EXIF orientation, 1 (upright) to 8.
+	Orientation int
+}
+
+const (
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+)
+
+// Read scans the JPEG header segments in r for an EXIF block. It stops at
+// the start of the image data, so only the header is read. Non-JPEG input
+// and JPEGs without EXIF give ErrNoExif.
+func Read(r io.Reader) (*Info, error) {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, ErrNoExif
+	}
+
+	for {
+		marker, err := nextMarker(br)
+		if err != nil {
+			return nil, ErrNoExif
+		}
+		// Start of scan or end of image: no EXIF before the image data.
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, ErrNoExif
+		}
+		// Standalone markers have no length.
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, ErrNoExif
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, ErrNoExif
+		}
+
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseTIFF(segment[6:])
+		}
+	}
+}
+
+// nextMarker skips to the next 0xFF marker and returns its code.
+func nextMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, ErrNoExif
+	}
+	// Any number of 0xFF fill bytes may precede the code.
+	for b == 0xFF {
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the 4-byte value/offset field
+}
+
+func parseTIFF(data []byte) (*Info, error) {
+	if len(data) < 8 {
+		return nil, ErrNoExif
+	}
+	t := &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrNoExif
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, ErrNoExif
+	}
+
+	ifd0 := t.readIFD(t.order.Uint32(data[4:]))
+	info := &Info{}
+
+	if e, ok := ifd0[tagOrientation]; ok && e.typ == 3 {
+		if o := int(t.order.Uint16(e.value)); o >= 1 && o <= 8 {
+			info.Orientation = o
+		}
+	}
+
+	taken, offset := t.ascii(ifd0[tagDateTime]), ""
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exifIFD := t.readIFD(t.order.Uint32(e.value))
+		if original := t.ascii(exifIFD[tagDateTimeOriginal]); original != "" {
+			taken = original
+			offset = t.ascii(exifIFD[tagOffsetTimeOriginal])
+		}
+	}
+	info.Taken = parseTime(taken, offset)
+
+	return info, nil
+}
+
+// readIFD returns the entries of the IFD at offset, keyed by tag. A
+// malformed or out-of-range IFD gives an empty map.
+func (t *tiff) readIFD(offset uint32) map[uint16]ifdEntry {
+	entries := map[uint16]ifdEntry{}
+	if int(offset)+2 > len(t.data) {
+		return entries
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(t.data) {
+		return entries
+	}
+	for i := 0; i < count; i++ {
+		raw := t.data[start+i*12:]
+		entries[t.order.Uint16(raw)] = ifdEntry{
+			typ:   t.order.Uint16(raw[2:]),
+			count: t.order.Uint32(raw[4:]),
+			value: raw[8:12],
+		}
+	}
+	return entries
+}
+
+// ascii returns the string value of an ASCII entry, or "".
+func (t *tiff) ascii(e ifdEntry) string {
+	if e.typ != 2 || e.count == 0 {
+		return ""
+	}
+	var raw []byte
+	if e.count <= 4 {
+		raw = e.value[:e.count]
+	} else {
+		offset := t.order.Uint32(e.value)
+		if uint64(offset)+uint64(e.count) > uint64(len(t.data)) {
+			return ""
+		}
+		raw = t.data[offset : offset+e.count]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+}
+
+// parseTime parses an EXIF "2006:01:02 15:04:05" time with an optional
+// "+01:00" offset. Unset or malformed times give the zero time.
+func parseTime(s, offset string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", s+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
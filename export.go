@@ -0,0 +1,230 @@
+// export.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/xlsx"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Job exports flatten each job into one row per room. The job's columns are
+// repeated on every row, followed by the room's fields and the prices for
+// the room and the whole job. Rows are written as the cursor is read so
+// exports of any size stream straight to the client.
+
+var exportJobColumns = []string{
+	"quoteId", "date", "completed", "customerName", "email", "phone",
+	"address", "addressLineOne", "addressLineTwo", "addressLineThree", "postCode",
+	"options", "planningPermission", "siteNotes",
+}
+
+func exportJobValues(job *Job) []interface{} {
+	return []interface{}{
+		job.QuoteID, job.Date, job.Completed, job.CustomerName, job.Email, job.Phone,
+		job.Address, job.AddressLineOne, job.AddressLineTwo, job.AddressLineThree, job.PostCode,
+		strings.Join(job.Options, ", "), job.PlanningPermission, job.SiteNotes,
+	}
+}
+
+var exportPriceColumns = []string{
+	"pricedOption", "roomTotal", "jobNet", "jobVat", "jobTotal",
+}
+
+// roomFields lists the stored Room struct fields in declaration order with
+// their JSON names, so every room field is exported without listing them
+// twice. Legacy fields that are folded away before saving are left out.
+var roomFields = func() []reflect.StructField {
+	t := reflect.TypeOf(Room{})
+	fields := make([]reflect.StructField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("bson") == "-" {
+			continue
+		}
+		fields = append(fields, t.Field(i))
+	}
+	return fields
+}()
+
+func exportHeader() []string {
+	header := append([]string{}, exportJobColumns...)
+	for _, field := range roomFields {
+		header = append(header, "room."+strings.Split(field.Tag.Get("json"), ",")[0])
+	}
+	return append(header, exportPriceColumns...)
+}
+
+// exportRows returns the rows for one job. A job without rooms still gets a
+// row, with the room columns left empty.
+func exportRows(job *Job) [][]interface{} {
+	jobValues := exportJobValues(job)
+	option := quotedOption(job)
+	quote := priceJob(job, option)
+
+	rooms := job.Rooms
+	if len(rooms) == 0 {
+		rooms = []Room{{}}
+	}
+
+	rows := make([][]interface{}, 0, len(rooms))
+	for i := range rooms {
+		row := append([]interface{}{}, jobValues...)
+
+		value := reflect.ValueOf(rooms[i])
+		for j := range roomFields {
+			if len(job.Rooms) == 0 {
+				row = append(row, nil)
+				continue
+			}
+			row = append(row, value.Field(j).Interface())
+		}
+
+		var roomTotal interface{}
+		if i < len(quote.Rooms) {
+			roomTotal = roundMoney(quote.Rooms[i].Total)
+		}
+		row = append(row, option, roomTotal,
+			roundMoney(quote.Net), roundMoney(quote.VAT), roundMoney(quote.Total))
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// exportJobs streams the job list, with the same filters as GET /api/jobs,
+// as CSV (the default) or as an Excel workbook with format=xlsx.
+func exportJobs(c *fiber.Ctx) error {
+	format := c.Query("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Format must be csv or xlsx",
+		})
+	}
+
+	filter, err := jobListFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	cursor, err := jobCollection.Find(context.Background(), filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	filename := fmt.Sprintf("jobs-%s.%s", time.Now().Format("2006-01-02"), format)
+	c.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == "xlsx" {
+		c.Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	} else {
+		c.Set("Content-Type", "text/csv; charset=utf-8")
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cursor.Close(context.Background())
+
+		var err error
+		if format == "xlsx" {
+			err = writeJobsXLSX(w, cursor)
+		} else {
+			err = writeJobsCSV(w, cursor)
+		}
+		if err != nil {
+			// Headers have been sent, so all we can do is log and cut the
+			// response short.
+			log.Println("Job export error:", err)
+		}
+		w.Flush()
+	})
+
+	return nil
+}
+
+// csvCell defuses text that a spreadsheet would run as a formula, such as a
+// customer name of "=HYPERLINK(...)", by prefixing it with an apostrophe.
+// Plain numbers like a "-50" price change are left as they are.
+func csvCell(value string) string {
+	if value == "" || !strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return "'" + value
+}
+
+func writeJobsCSV(w *bufio.Writer, cursor *mongo.Cursor) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(exportHeader()); err != nil {
+		return err
+	}
+
+	for cursor.Next(context.Background()) {
+		var job Job
+		if err := cursor.Decode(&job); err != nil {
+			return err
+		}
+
+		for _, row := range exportRows(&job) {
+			record := make([]string, len(row))
+			for i, value := range row {
+				if value != nil {
+					record[i] = csvCell(fmt.Sprint(value))
+				}
+			}
+			if err := out.Write(record); err != nil {
+				return err
+			}
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func writeJobsXLSX(w *bufio.Writer, cursor *mongo.Cursor) error {
+	out, err := xlsx.NewWriter(w, "Jobs")
+	if err != nil {
+		return err
+	}
+
+	header := exportHeader()
+	headerRow := make([]interface{}, len(header))
+	for i, column := range header {
+		headerRow[i] = column
+	}
+	if err := out.WriteRow(headerRow); err != nil {
+		return err
+	}
+
+	for cursor.Next(context.Background()) {
+		var job Job
+		if err := cursor.Decode(&job); err != nil {
+			return err
+		}
+
+		for _, row := range exportRows(&job) {
+			if err := out.WriteRow(row); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,365 @@
+// ics.go
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// iCalendar feeds let fitters subscribe to their surveys and fitting
+// bookings from a phone calendar. Calendar apps cannot send a JWT, so each
+// user has a separate random token that is part of the feed URL and can be
+// revoked on its own. A feed holds the open surveys assigned to the token's
+// user, who by default is whoever created the job, and the fitting bookings
+// of the team chosen when the token was issued.
+
+// surveyLookback is how far back surveys are still included in feeds.
+const surveyLookback = time.Hour * 24 * 30
+
+type CalendarEvent struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Location    string
+	Description string
+	URL         string
+}
+
+func newCalendarToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// icsEscape escapes a TEXT value as required by RFC 5545.
+func icsEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// icsLine folds a content line so that no line is longer than 75 octets,
+// continuing with a space, and terminates it with CRLF. The space counts
+// towards the limit, so continuation lines carry 74 octets of the value.
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// Do not split a UTF-8 sequence.
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func renderCalendar(name string, events []CalendarEvent) string {
+	var b strings.Builder
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//Preservation Windows//Quotes//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "METHOD:PUBLISH")
+	icsLine(&b, "X-WR-CALNAME:"+icsEscape(name))
+	for _, event := range events {
+		icsLine(&b, "BEGIN:VEVENT")
+		icsLine(&b, "UID:"+event.UID)
+		icsLine(&b, "DTSTAMP:"+stamp)
+		icsLine(&b, "DTSTART;VALUE=DATE:"+event.Start.Format("20060102"))
+		icsLine(&b, "DTEND;VALUE=DATE:"+event.End.Format("20060102"))
+		icsLine(&b, "SUMMARY:"+icsEscape(event.Summary))
+		if event.Location != "" {
+			icsLine(&b, "LOCATION:"+icsEscape(event.Location))
+		}
+		if event.Description != "" {
+			icsLine(&b, "DESCRIPTION:"+icsEscape(event.Description))
+		}
+		if event.URL != "" {
+			icsLine(&b, "URL:"+event.URL)
+		}
+		icsLine(&b, "END:VEVENT")
+	}
+	icsLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+func jobLocation(job *Job) string {
+	var parts []string
+	for _, part := range []string{job.AddressLineOne, job.AddressLineTwo, job.AddressLineThree, job.PostCode} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return job.Address
+	}
+	return strings.Join(parts, ", ")
+}
+
+func jobDescription(job *Job, link string, extra ...string) string {
+	lines := []string{"Customer: " + job.CustomerName}
+	if job.Phone != "" {
+		lines = append(lines, "Phone: "+job.Phone)
+	}
+	if job.QuoteID != "" {
+		lines = append(lines, "Quote: "+job.QuoteID)
+	}
+	lines = append(lines, extra...)
+	lines = append(lines, link)
+	return strings.Join(lines, "\n")
+}
+
+// publicURL is the base for links back into the app. PUBLIC_URL is used
+// when set since the feed may be fetched through a proxy.
+func publicURL(c *fiber.Ctx) string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return c.BaseURL()
+}
+
+// surveyEvents returns the open jobs assigned to surveyor, dated from
+// surveyLookback ago onwards.
+func surveyEvents(baseURL, surveyor string) ([]CalendarEvent, error) {
+	since := time.Now().Add(-surveyLookback).Format("2006-01-02")
+	filter := notDeleted(bson.M{
+		"surveyor":  surveyor,
+		"completed": false,
+		"date":      bson.M{"$gte": since},
+	})
+
+	cursor, err := jobCollection.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var events []CalendarEvent
+	for cursor.Next(context.Background()) {
+		var job Job
+		if err := cursor.Decode(&job); err != nil {
+			return nil, err
+		}
+		date, err := time.Parse("2006-01-02", job.Date)
+		if err != nil {
+			continue
+		}
+
+		link := baseURL + "/viewSingle/" + job.ID.Hex()
+		events = append(events, CalendarEvent{
+			UID:         "survey-" + job.ID.Hex() + "@preservation-windows",
+			Start:       date,
+			End:         date.AddDate(0, 0, 1),
+			Summary:     "Survey: " + job.CustomerName,
+			Location:    jobLocation(&job),
+			Description: jobDescription(&job, link),
+			URL:         link,
+		})
+	}
+	return events, cursor.Err()
+}
+
+// fittingEvents returns the bookings for team, or for every team when team
+// is empty, that have not finished before surveyLookback ago. Bookings for
+// drawings in the trash are left out.
+func fittingEvents(baseURL, team string) ([]CalendarEvent, error) {
+	filter := bson.M{"end": bson.M{"$gte": time.Now().Add(-surveyLookback)}}
+	if team != "" {
+		filter["team"] = team
+	}
+
+	cursor, err := scheduleCollection.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var bookings []Booking
+	if err := cursor.All(context.Background(), &bookings); err != nil {
+		return nil, err
+	}
+
+	drawingIDs := make([]primitive.ObjectID, 0, len(bookings))
+	for _, booking := range bookings {
+		drawingIDs = append(drawingIDs, booking.DrawingID)
+	}
+	drawings := map[primitive.ObjectID]Job{}
+	if len(drawingIDs) > 0 {
+		cursor, err := drawingCollection.Find(context.Background(), bson.M{"_id": bson.M{"$in": drawingIDs}})
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(context.Background())
+		for cursor.Next(context.Background()) {
+			var drawing Job
+			if err := cursor.Decode(&drawing); err != nil {
+				return nil, err
+			}
+			drawings[drawing.ID] = drawing
+		}
+	}
+
+	events := make([]CalendarEvent, 0, len(bookings))
+	for _, booking := range bookings {
+		drawing, ok := drawings[booking.DrawingID]
+		if ok && drawing.DeletedAt != nil {
+			continue
+		}
+		if !ok {
+			drawing = Job{CustomerName: booking.CustomerName, QuoteID: booking.QuoteID}
+		}
+
+		extra := []string{"Team: " + booking.Team, fmt.Sprintf("Days: %d", booking.Days)}
+		if booking.Notes != "" {
+			extra = append(extra, "Notes: "+booking.Notes)
+		}
+		link := baseURL + "/viewDrawing/" + booking.DrawingID.Hex()
+		events = append(events, CalendarEvent{
+			UID:         "fitting-" + booking.ID.Hex() + "@preservation-windows",
+			Start:       booking.Start,
+			End:         booking.End,
+			Summary:     "Fitting (" + booking.Team + "): " + drawing.CustomerName,
+			Location:    jobLocation(&drawing),
+			Description: jobDescription(&drawing, link, extra...),
+			URL:         link,
+		})
+	}
+	return events, nil
+}
+
+// getCalendarFeed serves the feed for a token: the open surveys assigned to
+// its user and the fitting bookings of its team, or of every team if it has
+// none.
+func getCalendarFeed(c *fiber.Ctx) error {
+	token := c.Params("token")
+
+	var user User
+	err := userCollection.FindOne(context.Background(), bson.M{"calendarToken": token}).Decode(&user)
+	if token == "" || err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Calendar not found",
+		})
+	}
+
+	baseURL := publicURL(c)
+	surveys, err := surveyEvents(baseURL, user.Email)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	fittings, err := fittingEvents(baseURL, user.CalendarTeam)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	c.Set("Content-Type", "text/calendar; charset=utf-8")
+	c.Set("Content-Disposition", `inline; filename="preservation-windows.ics"`)
+	return c.SendString(renderCalendar("Preservation Windows", append(surveys, fittings...)))
+}
+
+// createCalendarToken issues a new feed token for the current user,
+// replacing any previous one. An optional team limits fitting bookings in
+// the feed to that team.
+func createCalendarToken(c *fiber.Ctx) error {
+	type Request struct {
+		Team string `json:"team"`
+	}
+
+	var req Request
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid JSON",
+			})
+		}
+	}
+
+	claims := currentClaims(c)
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired JWT",
+		})
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired JWT",
+		})
+	}
+
+	token, err := newCalendarToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	update := bson.M{"$set": bson.M{"calendarToken": token, "calendarTeam": req.Team}}
+	result, err := userCollection.UpdateOne(context.Background(), bson.M{"_id": userID}, update)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"url":  publicURL(c) + "/api/calendar/feed/" + token + ".ics",
+		"team": req.Team,
+	})
+}
+
+func deleteCalendarToken(c *fiber.Ctx) error {
+	claims := currentClaims(c)
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired JWT",
+		})
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired JWT",
+		})
+	}
+
+	update := bson.M{"$unset": bson.M{"calendarToken": "", "calendarTeam": ""}}
+	if _, err := userCollection.UpdateOne(context.Background(), bson.M{"_id": userID}, update); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Calendar feed revoked"})
+}
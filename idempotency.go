@@ -0,0 +1,148 @@
+// idempotency.go
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Clients that may retry a request send the same Idempotency-Key header on
+// every attempt. The first attempt is run and its response kept for
+// idempotencyTTL; retries get that response back without the handler
+// running again, so a retried create cannot make a second job.
+
+const (
+	idempotencyTTL = 24 * time.Hour
+	// A key still marked in progress after this long belongs to a request
+	// that never finished, e.g. because the server restarted mid-way.
+	idempotencyStale  = time.Minute
+	maxIdempotencyKey = 255
+)
+
+// IdempotencyRecord is a request seen with an Idempotency-Key. Keys are
+// scoped to the user and route, so two users cannot collide.
+type IdempotencyRecord struct {
+	ID          string    `bson:"_id"`
+	RequestHash string    `bson:"requestHash"`
+	Done        bool      `bson:"done"`
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"contentType,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt"`
+}
+
+// claimIdempotencyKey records the request as in progress. If the key has
+// been seen before it returns the earlier record instead.
+func claimIdempotencyKey(record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	for attempt := 0; ; attempt++ {
+		_, err := idempotencyCollection.InsertOne(context.Background(), record)
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		var existing IdempotencyRecord
+		err = idempotencyCollection.FindOne(context.Background(), bson.M{"_id": record.ID}).Decode(&existing)
+		if err == mongo.ErrNoDocuments && attempt == 0 {
+			continue // expired or abandoned in between
+		}
+		if err != nil {
+			return nil, err
+		}
+		if existing.Done || attempt > 0 || time.Since(existing.CreatedAt) < idempotencyStale {
+			return &existing, nil
+		}
+
+		// Take over an abandoned claim, unless someone else just did.
+		_, err = idempotencyCollection.DeleteOne(context.Background(), bson.M{
+			"_id":       existing.ID,
+			"done":      false,
+			"createdAt": existing.CreatedAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// idempotent makes a handler safe to retry with an Idempotency-Key header.
+// Requests without the header are passed straight through. Server errors
+// release the key so the request can be retried for real; any other
+// response, including a validation error, is what every retry will get.
+func idempotent(c *fiber.Ctx) error {
+	key := c.Get("Idempotency-Key")
+	if key == "" {
+		return c.Next()
+	}
+	if len(key) > maxIdempotencyKey {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Idempotency-Key is too long",
+		})
+	}
+
+	user := ""
+	if claims := currentClaims(c); claims != nil {
+		user = claims.Subject
+	}
+	hash := sha256.Sum256(c.Body())
+	record := IdempotencyRecord{
+		ID:          strings.Join([]string{user, c.Method(), c.Path(), key}, " "),
+		RequestHash: hex.EncodeToString(hash[:]),
+		CreatedAt:   time.Now(),
+	}
+
+	existing, err := claimIdempotencyKey(&record)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if existing != nil {
+		if existing.RequestHash != record.RequestHash {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Idempotency-Key was already used for a different request",
+			})
+		}
+		if !existing.Done {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "A request with this Idempotency-Key is still in progress",
+			})
+		}
+		c.Set("Idempotent-Replayed", "true")
+		c.Set(fiber.HeaderContentType, existing.ContentType)
+		return c.Status(existing.Status).Send(existing.Body)
+	}
+
+	err = c.Next()
+	status := c.Response().StatusCode()
+	if err != nil || status >= fiber.StatusInternalServerError {
+		idempotencyCollection.DeleteOne(context.Background(), bson.M{"_id": record.ID})
+		return err
+	}
+
+	_, dbErr := idempotencyCollection.UpdateOne(context.Background(),
+		bson.M{"_id": record.ID},
+		bson.M{"$set": bson.M{
+			"done":        true,
+			"status":      status,
+			"contentType": string(c.Response().Header.ContentType()),
+			"body":        c.Response().Body(),
+		}})
+	if dbErr != nil {
+		// The request itself succeeded; a retry will just be refused as
+		// in progress until the claim goes stale.
+		log.Println("Idempotency record error:", dbErr)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// images.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"time"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/blob"
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/imaging"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Uploaded images are stored upright and stripped of metadata, alongside
+// smaller variants for thumbnails and on-screen viewing. Variants are kept
+// under the original's blob key plus "-<size>".
+
+// imageSlots limits how many uploads are decoded and resized at once.
+// Each can hold a couple of hundred megabytes while it is processed (see
+// imaging.MaxPixels), so a burst of uploads waits here rather than
+// exhausting memory.
+var imageSlots = make(chan struct{}, 2)
+
+// imageVariants maps each variant name to its longest side in pixels.
+var imageVariants = map[string]int{
+	"thumb": 320,
+	"web":   1600,
+}
+
+// ImageInfo describes a stored image. It is embedded in Temp and Photo.
+type ImageInfo struct {
+	FileType string   `json:"fileType" bson:"fileType"`
+	Size     int64    `json:"size" bson:"size"`
+	Width    int      `json:"width,omitempty" bson:"width,omitempty"`
+	Height   int      `json:"height,omitempty" bson:"height,omitempty"`
+	Variants []string `json:"variants,omitempty" bson:"variants,omitempty"`
+}
+
+// openUpload opens the file uploaded as field, refusing it with 413 if it
+// is larger than maxUploadBytes.
+func openUpload(c *fiber.Ctx, field string) (multipart.File, *fiber.Error) {
+	fileHeader, err := c.FormFile(field)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Image file is required")
+	}
+	if fileHeader.Size > maxUploadBytes {
+		return nil, fiber.NewError(fiber.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Image must be no larger than %d MB", maxUploadBytes>>20))
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to open uploaded file")
+	}
+	return file, nil
+}
+
+// imageError maps the errors storeImage gives for a bad upload to their
+// responses. Other errors give nil and are the server's fault.
+func imageError(err error) *fiber.Error {
+	switch err {
+	case imaging.ErrUnsupported:
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "Only JPEG, PNG and GIF images are accepted")
+	case imaging.ErrTooLarge:
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Image must be no more than %d megapixels", imaging.MaxPixels/1000000))
+	}
+	return nil
+}
+
+func variantKey(key, size string) string {
+	return key + "-" + size
+}
+
+// storeImage processes the upload in r and stores it and its variants
+// under key. It returns imaging.ErrUnsupported for anything that is not a
+// JPEG, PNG or GIF, whatever its Content-Type header said.
+func storeImage(ctx context.Context, key string, r io.ReadSeeker) (ImageInfo, *imaging.Image, error) {
+	imageSlots <- struct{}{}
+	defer func() { <-imageSlots }()
+
+	img, err := imaging.Decode(r)
+	if err != nil {
+		return ImageInfo{}, nil, err
+	}
+
+	info := ImageInfo{
+		FileType: img.ContentType,
+		Width:    img.Bounds().Dx(),
+		Height:   img.Bounds().Dy(),
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img.RGBA, img.ContentType); err != nil {
+		return ImageInfo{}, nil, err
+	}
+	if info.Size, err = blobs.Put(ctx, key, &buf); err != nil {
+		return ImageInfo{}, nil, err
+	}
+
+	for size, max := range imageVariants {
+		if info.Width <= max && info.Height <= max {
+			continue
+		}
+		buf.Reset()
+		if err := imaging.Encode(&buf, imaging.Fit(img.RGBA, max), img.ContentType); err != nil {
+			deleteImage(ctx, key, info)
+			return ImageInfo{}, nil, err
+		}
+		if _, err := blobs.Put(ctx, variantKey(key, size), &buf); err != nil {
+			deleteImage(ctx, key, info)
+			return ImageInfo{}, nil, err
+		}
+		info.Variants = append(info.Variants, size)
+	}
+
+	return info, img, nil
+}
+
+// deleteImage removes an image and all of its variants.
+func deleteImage(ctx context.Context, key string, info ImageInfo) error {
+	for _, size := range info.Variants {
+		if err := blobs.Delete(ctx, variantKey(key, size)); err != nil {
+			return err
+		}
+	}
+	return blobs.Delete(ctx, key)
+}
+
+// sendImage streams the image, or the variant named by ?size=. An image
+// too small to need the variant, or stored before variants existed, is
+// sent at full size. Blobs are never rewritten under the same key, so the
+// key identifies the content; immutable says the URL will always give
+// this image and can be cached without revalidating.
+func sendImage(c *fiber.Ctx, key string, info ImageInfo, modified time.Time, immutable bool) error {
+	if size := c.Query("size"); size != "" && size != "original" {
+		if _, ok := imageVariants[size]; !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown image size",
+			})
+		}
+		for _, variant := range info.Variants {
+			if variant == size {
+				key = variantKey(key, size)
+			}
+		}
+	}
+
+	if immutable {
+		c.Set(fiber.HeaderCacheControl, cacheImmutable)
+	} else {
+		c.Set(fiber.HeaderCacheControl, cacheRevalidate)
+	}
+	if notModified(c, `"`+key+`"`, modified) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	image, length, err := blobs.Open(c.Context(), key)
+	if err == blob.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Image not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read image",
+		})
+	}
+
+	// SendStream closes image once the response has been written.
+	c.Set("Content-Type", info.FileType)
+	return c.SendStream(image, int(length))
+}
@@ -0,0 +1,228 @@
+// Package imaging decodes uploaded photos, puts them the right way up and
+// produces resized copies. Images are always re-encoded, so no metadata
+// from the upload (EXIF, including GPS position) survives.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/exif"
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported image type")
+	ErrTooLarge    = errors.New("image dimensions too large")
+)
+
+// MaxPixels limits the width times height of images Decode will accept,
+// since a small compressed file can expand to gigabytes once decoded.
+// Decoded images take 4 bytes a pixel, and Orient may make a second copy,
+// so 24 MP (6000x4000, more than a phone or survey camera gives by
+// default) costs up to about 200 MB.
+var MaxPixels = 24 * 1000 * 1000
+
+// Supported content types. GIFs are decoded but written back as PNG.
+const (
+	JPEG = "image/jpeg"
+	PNG  = "image/png"
+	GIF  = "image/gif"
+)
+
+// Detect returns the supported content type whose magic bytes header
+// starts with, or "" if none match.
+func Detect(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xFF\xD8\xFF")):
+		return JPEG
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1A\n")):
+		return PNG
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return GIF
+	}
+	return ""
+}
+
+// Sniff returns the content type of r from its magic bytes, whatever the
+// upload claimed, and rewinds r. Unsupported types give "".
+func Sniff(r io.ReadSeeker) (string, error) {
+	header := make([]byte, 8)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return Detect(header[:n]), nil
+}
+
+// Image is a decoded upload, already rotated upright.
+type Image struct {
+	*image.RGBA
+
+	// ContentType is the type the image should be stored as: JPEG for
+	// JPEG uploads, PNG for everything else so transparency is kept.
+	ContentType string
+
+	// Exif is what was read from the upload, or nil if it had none.
+	Exif *exif.Info
+}
+
+// Decode sniffs, decodes and orients the image in r. Types other than
+// JPEG, PNG and GIF give ErrUnsupported; images over MaxPixels give
+// ErrTooLarge before any pixels are decoded.
+func Decode(r io.ReadSeeker) (*Image, error) {
+	contentType, err := Sniff(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var decode func(io.Reader) (image.Image, error)
+	var decodeConfig func(io.Reader) (image.Config, error)
+	out := &Image{ContentType: PNG}
+	switch contentType {
+	case JPEG:
+		decode, decodeConfig = jpeg.Decode, jpeg.DecodeConfig
+		out.ContentType = JPEG
+		if info, err := exif.Read(r); err == nil {
+			out.Exif = info
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	case PNG:
+		decode, decodeConfig = png.Decode, png.DecodeConfig
+	case GIF:
+		decode, decodeConfig = gif.Decode, gif.DecodeConfig
+	default:
+		return nil, ErrUnsupported
+	}
+
+	config, err := decodeConfig(r)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	src, err := decode(r)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	out.RGBA = rgba
+	if out.Exif != nil {
+		out.RGBA = Orient(rgba, out.Exif.Orientation)
+	}
+	return out, nil
+}
+
+// Orient returns img transformed so that an image with the given EXIF
+// orientation displays upright. Orientations 5 to 8 swap width and height.
+func Orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	// source maps a destination pixel back to the pixel it comes from.
+	source := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return w - 1 - x, y },
+		3: func(x, y int) (int, int) { return w - 1 - x, h - 1 - y },
+		4: func(x, y int) (int, int) { return x, h - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, h - 1 - x },
+		7: func(x, y int) (int, int) { return w - 1 - y, h - 1 - x },
+		8: func(x, y int) (int, int) { return w - 1 - y, x },
+	}[orientation]
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := source(x, y)
+			si := img.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// Fit scales img down so neither side exceeds max, keeping its aspect
+// ratio. Each destination pixel is the average of the source pixels it
+// covers. Images that already fit are returned unchanged.
+func Fit(img *image.RGBA, max int) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w <= max && h <= max {
+		return img
+	}
+
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*w/dw, (x+1)*w/dw
+
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				i := img.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(img.Pix[i])
+					g += int(img.Pix[i+1])
+					b += int(img.Pix[i+2])
+					a += int(img.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			di := dst.PixOffset(x, y)
+			dst.Pix[di] = uint8(r / n)
+			dst.Pix[di+1] = uint8(g / n)
+			dst.Pix[di+2] = uint8(b / n)
+			dst.Pix[di+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Encode writes img as contentType, which must be JPEG or PNG.
+func Encode(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case JPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case PNG:
+		return png.Encode(w, img)
+	}
+	return ErrUnsupported
+}
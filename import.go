@@ -0,0 +1,386 @@
+// import.go
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Historical quotes are imported from CSV. Columns are matched to job and
+// room fields by the names used in exports ("customerName", "room.width"),
+// either directly or through a mapping of CSV header to field name. Rows
+// sharing a quoteId are one job with a room per row; rows without a quoteId
+// are a job each.
+
+// ImportRowError lists what is wrong with one CSV row. Row numbers count
+// the header as row 1, as a spreadsheet does.
+type ImportRowError struct {
+	Row     int      `json:"row"`
+	QuoteID string   `json:"quoteId,omitempty"`
+	Errors  []string `json:"errors"`
+}
+
+type ImportResult struct {
+	DryRun  bool             `json:"dryRun"`
+	Rows    int              `json:"rows"`
+	Jobs    int              `json:"jobs"`
+	Created int              `json:"created"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+// importable fields by JSON name. Fields the server manages are left out.
+var (
+	importJobFields  = importFields(reflect.TypeOf(Job{}))
+	importRoomFields = importFields(reflect.TypeOf(Room{}))
+)
+
+func importFields(t reflect.Type) map[string]int {
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "_id", "rooms", "prices", "deletedAt", "deletedBy", "customerId", "propertyId":
+			continue
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// setImportField parses raw into the struct field at index i of v.
+func setImportField(v reflect.Value, i int, raw string) error {
+	field := v.Field(i)
+	raw = strings.TrimSpace(raw)
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		if raw == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("not a whole number: %q", raw)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		if raw == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimPrefix(raw, "£"), 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", raw)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		switch strings.ToLower(raw) {
+		case "", "false", "no", "n", "0":
+			field.SetBool(false)
+		case "true", "yes", "y", "1", "x":
+			field.SetBool(true)
+		default:
+			return fmt.Errorf("not yes/no: %q", raw)
+		}
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot be imported")
+	}
+	return nil
+}
+
+var (
+	validCills  = map[string]bool{"": true, "Full": true, "Half": true, "Repairs": true}
+	validSashes = map[string]bool{"": true, "Top": true, "Bottom": true, "Both": true}
+)
+
+// validateJob checks a job against the rules the quote forms enforce. Its
+// address is normalised as a side effect.
+func validateJob(job *Job) []string {
+	var problems []string
+
+	if strings.TrimSpace(job.CustomerName) == "" {
+		problems = append(problems, "customerName is required")
+	}
+	if _, err := time.Parse("2006-01-02", job.Date); err != nil {
+		problems = append(problems, "date must be YYYY-MM-DD")
+	}
+	if err := normaliseJobAddress(job); err != nil {
+		problems = append(problems, "postCode: "+err.Error())
+	}
+	for _, option := range job.Options {
+		if option != OptionNewWindows && option != OptionRefurb && option != OptionPVC {
+			problems = append(problems, fmt.Sprintf("unknown option %q", option))
+		}
+	}
+	if !validPlanningPermission(job.PlanningPermission) {
+		problems = append(problems, fmt.Sprintf("unknown planningPermission %q", job.PlanningPermission))
+	}
+
+	for i, room := range job.Rooms {
+		prefix := fmt.Sprintf("room %d: ", i+1)
+		if room.Width <= 0 || room.Height <= 0 {
+			problems = append(problems, prefix+"width and height must be positive")
+		}
+		if room.Count < 0 || room.PanesNumber < 0 || room.StainRepairs < 0 || room.Encapsulation < 0 {
+			problems = append(problems, prefix+"counts cannot be negative")
+		}
+		if !validCills[room.Cill] {
+			problems = append(problems, fmt.Sprintf("%sunknown cill %q", prefix, room.Cill))
+		}
+		if !validSashes[room.Sash] {
+			problems = append(problems, fmt.Sprintf("%sunknown sash %q", prefix, room.Sash))
+		}
+		if _, ok := glassTypeCosts[room.GlassType]; room.GlassType != "" && !ok {
+			problems = append(problems, fmt.Sprintf("%sunknown glassType %q", prefix, room.GlassType))
+		}
+	}
+	return problems
+}
+
+type importJob struct {
+	job  Job
+	row  int
+	errs []string
+}
+
+// parseImport reads the CSV into jobs. Problems with individual values are
+// recorded against the job rather than stopping the import.
+func parseImport(r io.Reader, mapping map[string]string) ([]*importJob, int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read CSV header: %w", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if mapped, ok := mapping[name]; ok {
+			name = mapped
+		}
+		columns[i] = name
+	}
+
+	var jobs []*importJob
+	byQuoteID := map[string]*importJob{}
+	rows := 0
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rows++
+		row := rows + 1
+		if err != nil {
+			jobs = append(jobs, &importJob{row: row, errs: []string{err.Error()}})
+			continue
+		}
+
+		var job Job
+		var room Room
+		var errs []string
+		hasRoom := false
+		jobValue := reflect.ValueOf(&job).Elem()
+		roomValue := reflect.ValueOf(&room).Elem()
+
+		for i, raw := range record {
+			if i >= len(columns) {
+				break
+			}
+			column := columns[i]
+			if name, ok := strings.CutPrefix(column, "room."); ok {
+				if index, ok := importRoomFields[name]; ok {
+					if err := setImportField(roomValue, index, raw); err != nil {
+						errs = append(errs, column+": "+err.Error())
+					}
+					hasRoom = hasRoom || strings.TrimSpace(raw) != ""
+				}
+				continue
+			}
+			if index, ok := importJobFields[column]; ok {
+				if err := setImportField(jobValue, index, raw); err != nil {
+					errs = append(errs, column+": "+err.Error())
+				}
+			}
+		}
+
+		current, ok := byQuoteID[job.QuoteID]
+		if job.QuoteID == "" || !ok {
+			current = &importJob{job: job, row: row}
+			jobs = append(jobs, current)
+			if job.QuoteID != "" {
+				byQuoteID[job.QuoteID] = current
+			}
+		}
+		if hasRoom {
+			current.job.Rooms = append(current.job.Rooms, room)
+		}
+		current.errs = append(current.errs, errs...)
+	}
+
+	return jobs, rows, nil
+}
+
+// importJobs handles POST /api/jobs/import. The multipart form takes the
+// CSV as "file", an optional JSON "mapping" of CSV header to field name,
+// "dryRun" to validate without saving and "keepQuoteIds" to keep the quote
+// numbers from the file instead of issuing new ones. Quote numbers can only
+// be kept while QUOTE_NUMBER_FORMAT is the plain {seq}, as the numbers in
+// the file are taken to be sequence numbers. Nothing is saved if any row
+// has an error.
+func importJobs(c *fiber.Ctx) error {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "CSV file is required",
+		})
+	}
+
+	mapping := map[string]string{}
+	if raw := c.FormValue("mapping"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Mapping must be a JSON object of CSV column to field",
+			})
+		}
+	}
+	dryRun := c.FormValue("dryRun") == "true" || c.QueryBool("dryRun")
+	keepQuoteIDs := c.FormValue("keepQuoteIds") == "true" || c.QueryBool("keepQuoteIds")
+	if keepQuoteIDs && quoteNumbers.Format != "{seq}" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Quote numbers can only be kept when the quote number format is {seq}",
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to open uploaded file",
+		})
+	}
+	defer file.Close()
+
+	jobs, rows, err := parseImport(file, mapping)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	result := ImportResult{DryRun: dryRun, Rows: rows, Jobs: len(jobs), Errors: []ImportRowError{}}
+	maxQuoteID := 0
+	for _, item := range jobs {
+		item.errs = append(item.errs, validateJob(&item.job)...)
+
+		if keepQuoteIDs {
+			n, err := strconv.Atoi(item.job.QuoteID)
+			if err != nil {
+				item.errs = append(item.errs, "quoteId must be a number to keep it")
+			} else {
+				count, err := jobCollection.CountDocuments(context.Background(), bson.M{"quoteId": item.job.QuoteID})
+				if err != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+						"error": "Database error",
+					})
+				}
+				if count > 0 {
+					item.errs = append(item.errs, "quoteId "+item.job.QuoteID+" is already in use")
+				}
+				if n > maxQuoteID {
+					maxQuoteID = n
+				}
+			}
+		}
+
+		if len(item.errs) > 0 {
+			result.Errors = append(result.Errors, ImportRowError{
+				Row:     item.row,
+				QuoteID: item.job.QuoteID,
+				Errors:  item.errs,
+			})
+		}
+	}
+
+	if dryRun || len(result.Errors) > 0 {
+		status := fiber.StatusOK
+		if len(result.Errors) > 0 {
+			status = fiber.StatusUnprocessableEntity
+		}
+		return c.Status(status).JSON(result)
+	}
+
+	// Keep the counter ahead of imported quote numbers so new quotes never
+	// reuse one.
+	if keepQuoteIDs && maxQuoteID > 0 {
+		if err := advanceCounter(quoteNumbers.Counter, maxQuoteID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to update quote counter",
+			})
+		}
+	}
+
+	for _, item := range jobs {
+		job := &item.job
+		if err := linkJobCustomer(job); err != nil {
+			return importFailed(c, result, item.row, err)
+		}
+		if err := linkJobProperty(job); err != nil {
+			return importFailed(c, result, item.row, err)
+		}
+		foldLegacyRoomFields(job)
+		assignRoomIDs(job, nil)
+		job.Prices = jobPrices(job)
+
+		job.ID = primitive.NilObjectID
+		if !keepQuoteIDs {
+			if ferr := insertJob(job); ferr != nil {
+				return importFailed(c, result, item.row, ferr)
+			}
+			result.Created++
+			continue
+		}
+
+		// Kept numbers go in the plain series under the same unique index
+		// as issued ones; validation above made sure QuoteID is a number.
+		job.QuoteSeries = quoteNumbers.Counter
+		job.QuoteSeq, _ = strconv.Atoi(job.QuoteID)
+		job.Rev = 1
+		job.UpdatedAt = time.Now()
+		if _, err := jobCollection.InsertOne(context.Background(), job); err != nil {
+			return importFailed(c, result, item.row, err)
+		}
+		result.Created++
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(result)
+}
+
+// importFailed reports a database error part way through an import, with
+// how many jobs had already been created.
+func importFailed(c *fiber.Ctx, result ImportResult, row int, err error) error {
+	result.Errors = append(result.Errors, ImportRowError{Row: row, Errors: []string{err.Error()}})
+	return c.Status(fiber.StatusInternalServerError).JSON(result)
+}
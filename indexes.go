@@ -0,0 +1,83 @@
+// indexes.go
+
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes lists the indexes each collection relies on. Creating an
+// index that already exists is a no-op, so this is safe to run on startup.
+func collectionIndexes() map[*mongo.Collection][]mongo.IndexModel {
+	return map[*mongo.Collection][]mongo.IndexModel{
+		userCollection: {
+			{Keys: bson.D{{Key: "calendarToken", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		},
+		jobCollection: {
+			{Keys: bson.D{{Key: "customerId", Value: 1}}},
+			{Keys: bson.D{{Key: "propertyId", Value: 1}}},
+			{Keys: bson.D{{Key: "date", Value: 1}}},
+			{Keys: bson.D{{Key: "updatedAt", Value: 1}}},
+			{Keys: bson.D{{Key: "surveyor", Value: 1}, {Key: "date", Value: 1}}},
+			quoteNumbers.numberIndex(),
+		},
+		drawingCollection: {
+			{Keys: bson.D{{Key: "propertyId", Value: 1}}},
+			{Keys: bson.D{{Key: "quoteId", Value: 1}}},
+			{Keys: bson.D{{Key: "updatedAt", Value: 1}}},
+			drawingNumbers.numberIndex(),
+		},
+		customerCollection: {
+			{Keys: bson.D{{Key: "matchKeys", Value: 1}}},
+		},
+		propertyCollection: {
+			{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		scheduleCollection: {
+			{Keys: bson.D{{Key: "team", Value: 1}, {Key: "start", Value: 1}}},
+			{Keys: bson.D{{Key: "drawingId", Value: 1}}},
+		},
+		costCollection: {
+			{Keys: bson.D{{Key: "targetType", Value: 1}, {Key: "targetId", Value: 1}}},
+		},
+		tempsCollection: {
+			// Temps from before versioning have no version and are left out
+			{
+				Keys: bson.D{{Key: "name", Value: 1}, {Key: "version", Value: -1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"version": bson.M{"$exists": true}}),
+			},
+		},
+		photoCollection: {
+			{Keys: bson.D{{Key: "targetType", Value: 1}, {Key: "targetId", Value: 1}, {Key: "room", Value: 1}, {Key: "order", Value: 1}}},
+			{Keys: bson.D{{Key: "blobKey", Value: 1}}},
+		},
+		idempotencyCollection: {
+			{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(idempotencyTTL.Seconds()))},
+		},
+		webhookCollection: {
+			{Keys: bson.D{{Key: "events", Value: 1}}},
+		},
+		webhookDeliveryCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+			{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		},
+		auditCollection: {
+			{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+			{Keys: bson.D{{Key: "targetId", Value: 1}}},
+		},
+	}
+}
+
+func ensureIndexes() error {
+	for collection, models := range collectionIndexes() {
+		if _, err := collection.Indexes().CreateMany(context.Background(), models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+// labour.go
+
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The labour model turns a room's window size, formation and work items
+// into workshop and site minutes per window. It is stored in the settings
+// collection so it can be tuned without a release; until it has been
+// saved the defaults below apply.
+
+const labourModelID = "labourModel"
+
+// LabourTime is the work for one window, split between the workshop and
+// the site.
+type LabourTime struct {
+	Workshop float64 `json:"workshop" bson:"workshop"`
+	Site     float64 `json:"site" bson:"site"`
+}
+
+func (t LabourTime) add(other LabourTime, times float64) LabourTime {
+	return LabourTime{
+		Workshop: t.Workshop + other.Workshop*times,
+		Site:     t.Site + other.Site*times,
+	}
+}
+
+// SizeBand scales the per-window minutes for windows up to MaxArea square
+// metres. Bands are checked in order; windows larger than every band use
+// the last one.
+type SizeBand struct {
+	MaxArea    float64 `json:"maxArea" bson:"maxArea"`
+	Multiplier float64 `json:"multiplier" bson:"multiplier"`
+}
+
+type LabourModel struct {
+	ID string `json:"-" bson:"_id"`
+	// Base minutes per window for each job option.
+	Base map[string]LabourTime `json:"base" bson:"base"`
+	// Extra minutes per window by formation, e.g. "6/6".
+	Formation map[string]LabourTime `json:"formation" bson:"formation"`
+	// Minutes per window for each work item. Boolean room fields use their
+	// JSON name ("putty"); counted fields are multiplied by the count
+	// ("panesNumber"); cill and sash use "cill:Full", "sash:Both" etc.
+	Items     map[string]LabourTime `json:"items" bson:"items"`
+	SizeBands []SizeBand            `json:"sizeBands" bson:"sizeBands"`
+	// Fitters per team and the hours each works in a day on site.
+	TeamSize    int     `json:"teamSize" bson:"teamSize"`
+	HoursPerDay float64 `json:"hoursPerDay" bson:"hoursPerDay"`
+}
+
+func defaultLabourModel() *LabourModel {
+	return &LabourModel{
+		ID: labourModelID,
+		Base: map[string]LabourTime{
+			OptionRefurb:     {Workshop: 60, Site: 240},
+			OptionNewWindows: {Workshop: 480, Site: 180},
+			OptionPVC:        {Workshop: 0, Site: 120},
+		},
+		Formation: map[string]LabourTime{
+			"2/2": {Workshop: 15, Site: 10},
+			"3/3": {Workshop: 30, Site: 15},
+			"4/4": {Workshop: 45, Site: 20},
+			"6/6": {Workshop: 60, Site: 30},
+		},
+		Items: map[string]LabourTime{
+			"putty":          {Site: 45},
+			"mastic":         {Site: 20},
+			"masticPatch":    {Site: 30},
+			"outsidePatch":   {Site: 30},
+			"paint":          {Site: 120},
+			"tenon":          {Workshop: 60, Site: 30},
+			"bottomRail":     {Workshop: 90, Site: 30},
+			"pullyWheel":     {Site: 45},
+			"easyClean":      {Workshop: 30, Site: 30},
+			"concealedVent":  {Workshop: 20, Site: 15},
+			"trickleVent":    {Workshop: 15, Site: 15},
+			"handles":        {Workshop: 20, Site: 10},
+			"sashRestrictor": {Site: 15},
+			"shutters":       {Site: 60},
+			"dormer":         {Site: 60},
+			"panesNumber":    {Site: 40},
+			"stainRepairs":   {Site: 20},
+			"cill:Full":      {Workshop: 120, Site: 90},
+			"cill:Half":      {Workshop: 60, Site: 60},
+			"cill:Repairs":   {Site: 45},
+			"sash:Top":       {Workshop: 240, Site: 45},
+			"sash:Bottom":    {Workshop: 240, Site: 45},
+			"sash:Both":      {Workshop: 480, Site: 90},
+		},
+		SizeBands: []SizeBand{
+			{MaxArea: 1, Multiplier: 0.8},
+			{MaxArea: 2, Multiplier: 1},
+			{MaxArea: 3, Multiplier: 1.25},
+			{MaxArea: 0, Multiplier: 1.5},
+		},
+		TeamSize:    2,
+		HoursPerDay: 7.5,
+	}
+}
+
+func loadLabourModel() (*LabourModel, error) {
+	var model LabourModel
+	err := settingsCollection.FindOne(context.Background(), bson.M{"_id": labourModelID}).Decode(&model)
+	if err == mongo.ErrNoDocuments {
+		return defaultLabourModel(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func (m *LabourModel) sizeMultiplier(room *Room) float64 {
+	area := float64(room.Width) * float64(room.Height) / 1e6
+	for i, band := range m.SizeBands {
+		if area <= band.MaxArea || i == len(m.SizeBands)-1 {
+			return band.Multiplier
+		}
+	}
+	return 1
+}
+
+// roomItems lists the work items on a room with how many of each there are
+// per window.
+func roomItems(room *Room) map[string]float64 {
+	items := map[string]float64{}
+	flags := map[string]bool{
+		"putty":          room.Putty,
+		"mastic":         room.Mastic,
+		"masticPatch":    room.MasticPatch,
+		"outsidePatch":   room.OutsidePatch,
+		"paint":          room.Paint,
+		"tenon":          room.Tenon,
+		"bottomRail":     room.BottomRail,
+		"pullyWheel":     room.PullyWheel,
+		"easyClean":      room.EasyClean,
+		"concealedVent":  room.ConcealedVent,
+		"trickleVent":    room.TrickleVent,
+		"handles":        room.Handles,
+		"sashRestrictor": room.SashRestrictor,
+		"shutters":       room.Shutters,
+		"dormer":         room.Dormer,
+		"casement":       room.Casement,
+	}
+	for name, set := range flags {
+		if set {
+			items[name] = 1
+		}
+	}
+	if room.PanesNumber > 0 {
+		items["panesNumber"] = float64(room.PanesNumber)
+	}
+	if room.StainRepairs > 0 {
+		items["stainRepairs"] = float64(room.StainRepairs)
+	}
+	if room.Encapsulation > 0 {
+		items["encapsulation"] = float64(room.Encapsulation)
+	}
+	if room.Cill != "" {
+		items["cill:"+room.Cill] = 1
+	}
+	if room.Sash != "" {
+		items["sash:"+room.Sash] = 1
+	}
+	return items
+}
+
+// perWindow returns the minutes to do one window of the room for option.
+func (m *LabourModel) perWindow(room *Room, option string) LabourTime {
+	t := m.Base[option]
+	formation := room.Formation
+	if room.CustomFormation != "" {
+		formation = room.CustomFormation
+	}
+	t = t.add(m.Formation[strings.TrimSpace(formation)], 1)
+	for name, count := range roomItems(room) {
+		t = t.add(m.Items[name], count)
+	}
+
+	multiplier := m.sizeMultiplier(room)
+	return LabourTime{Workshop: t.Workshop * multiplier, Site: t.Site * multiplier}
+}
+
+type RoomLabour struct {
+	Ref           string  `json:"ref"`
+	RoomName      string  `json:"roomName"`
+	Windows       int     `json:"windows"`
+	WorkshopHours float64 `json:"workshopHours"`
+	SiteHours     float64 `json:"siteHours"`
+}
+
+type LabourEstimate struct {
+	Option        string       `json:"option"`
+	WorkshopHours float64      `json:"workshopHours"`
+	SiteHours     float64      `json:"siteHours"`
+	ManHours      float64      `json:"manHours"`
+	SiteDays      int          `json:"siteDays"`
+	Rooms         []RoomLabour `json:"rooms"`
+}
+
+func roundHours(h float64) float64 {
+	return math.Round(h*100) / 100
+}
+
+func roomWindows(room *Room) int {
+	if room.Count < 1 {
+		return 1
+	}
+	return room.Count
+}
+
+// Estimate returns the labour for a job quoted as option.
+func (m *LabourModel) Estimate(job *Job, option string) LabourEstimate {
+	estimate := LabourEstimate{Option: option, Rooms: []RoomLabour{}}
+
+	var workshop, site float64
+	for i := range job.Rooms {
+		room := &job.Rooms[i]
+		windows := roomWindows(room)
+		t := m.perWindow(room, option)
+
+		roomWorkshop := t.Workshop * float64(windows) / 60
+		roomSite := t.Site * float64(windows) / 60
+		workshop += roomWorkshop
+		site += roomSite
+
+		estimate.Rooms = append(estimate.Rooms, RoomLabour{
+			Ref:           room.Ref,
+			RoomName:      room.RoomName,
+			Windows:       windows,
+			WorkshopHours: roundHours(roomWorkshop),
+			SiteHours:     roundHours(roomSite),
+		})
+	}
+
+	estimate.WorkshopHours = roundHours(workshop)
+	estimate.SiteHours = roundHours(site)
+	estimate.ManHours = roundHours(workshop + site)
+	estimate.SiteDays = m.siteDays(site)
+	return estimate
+}
+
+// siteDays converts site man-hours into working days for one team, never
+// less than one.
+func (m *LabourModel) siteDays(siteHours float64) int {
+	perDay := float64(m.TeamSize) * m.HoursPerDay
+	if perDay <= 0 {
+		return 1
+	}
+	days := int(math.Ceil(siteHours/perDay - 1e-9))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+// EstimateAll returns an estimate for each option the job is quoted for,
+// or for Refurb when it has none.
+func (m *LabourModel) EstimateAll(job *Job) []LabourEstimate {
+	options := job.Options
+	if len(options) == 0 {
+		options = []string{OptionRefurb}
+	}
+
+	estimates := make([]LabourEstimate, 0, len(options))
+	for _, option := range options {
+		estimates = append(estimates, m.Estimate(job, option))
+	}
+	return estimates
+}
+
+func estimateLabour(c *fiber.Ctx, collection *mongo.Collection, notFound string) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var job Job
+	err = collection.FindOne(context.Background(), notDeleted(bson.M{"_id": objID})).Decode(&job)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": notFound,
+		})
+	}
+
+	model, err := loadLabourModel()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not load labour model",
+		})
+	}
+
+	if option := c.Query("option"); option != "" {
+		return c.JSON(model.Estimate(&job, option))
+	}
+	return c.JSON(model.EstimateAll(&job))
+}
+
+func getJobLabour(c *fiber.Ctx) error {
+	return estimateLabour(c, jobCollection, "Could not find job")
+}
+
+func getDrawingLabour(c *fiber.Ctx) error {
+	return estimateLabour(c, drawingCollection, "Drawing not found")
+}
+
+func getLabourModel(c *fiber.Ctx) error {
+	model, err := loadLabourModel()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not load labour model",
+		})
+	}
+
+	return c.JSON(model)
+}
+
+func updateLabourModel(c *fiber.Ctx) error {
+	model := new(LabourModel)
+	if err := c.BodyParser(model); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	if model.TeamSize <= 0 || model.HoursPerDay <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Team size and hours per day must be positive",
+		})
+	}
+
+	model.ID = labourModelID
+	opts := options.Replace().SetUpsert(true)
+	_, err := settingsCollection.ReplaceOne(context.Background(), bson.M{"_id": labourModelID}, model, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not save labour model",
+		})
+	}
+
+	return c.JSON(model)
+}
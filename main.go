@@ -5,13 +5,14 @@ package main
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/blob"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	jwtware "github.com/gofiber/jwt/v3"
@@ -27,15 +28,16 @@ import (
 // Struct Definitions
 
 type Room struct {
+	RoomID             string  `json:"roomId,omitempty" bson:"roomId,omitempty"`
 	Ref                string  `json:"ref" bson:"ref"`
-	RoomName           string  `json:"roomName" bson:"roomname"`
+	RoomName           string  `json:"roomName" bson:"roomName"`
 	Width              int     `json:"width" bson:"width"`
 	Height             int     `json:"height" bson:"height"`
 	Putty              bool    `json:"putty" bson:"putty"`
 	Mastic             bool    `json:"mastic" bson:"mastic"`
 	Paint              bool    `json:"paint" bson:"paint"`
 	Tenon              bool    `json:"tenon" bson:"tenon"`
-	EC                 bool    `json:"eC" bson:"eC"`
+	EC                 bool    `json:"eC" bson:"-"`
 	Encapsulation      int     `json:"encapsulation" bson:"encapsulation"`
 	BottomRail         bool    `json:"bottomRail" bson:"bottomRail"`
 	Dormer             bool    `json:"dormer" bson:"dormer"`
@@ -51,7 +53,7 @@ type Room struct {
 	GlassType          string  `json:"glassType" bson:"glassType"`
 	GlassTypeTopBottom string  `json:"glassTypeTopBottom" bson:"glassTypeTopBottom"`
 	Casement           bool    `json:"casement" bson:"casement"`
-	PriceChange        float64 `json:"priceChange" bson:"priceChange"`
+	PriceChange        float64 `json:"priceChange" bson:"-"`
 	PriceChange2       string  `json:"priceChange2" bson:"priceChange2"`
 	PositiveNegative   string  `json:"positiveNegative" bson:"positiveNegative"`
 	PriceChangeNotes   string  `json:"priceChangeNotes" bson:"priceChangeNotes"`
@@ -76,11 +78,11 @@ type Job struct {
 	QuoteID            string             `json:"quoteId" bson:"quoteId"`
 	Completed          bool               `json:"completed" bson:"completed"`
 	Date               string             `json:"date" bson:"date"`
-	CustomerName       string             `json:"customerName" bson:"customername"`
+	CustomerName       string             `json:"customerName" bson:"customerName"`
 	Address            string             `json:"address" bson:"address"`
 	Email              string             `json:"email" bson:"email"`
 	Phone              string             `json:"phone" bson:"phone"`
-	PostCode           string             `json:"postCode" bson:"postcode"`
+	PostCode           string             `json:"postCode" bson:"postCode"`
 	Rooms              []Room             `json:"rooms" bson:"rooms"`
 	Options            []string           `json:"options" bson:"options"`
 	PlanningPermission string             `json:"planningPermission" bson:"planningPermission"`
@@ -88,13 +90,39 @@ type Job struct {
 	AddressLineOne     string             `json:"addressLineOne" bson:"addressLineOne"`
 	AddressLineTwo     string             `json:"addressLineTwo" bson:"addressLineTwo"`
 	AddressLineThree   string             `json:"addressLineThree" bson:"addressLineThree"`
+	CustomerID         primitive.ObjectID `json:"customerId,omitempty" bson:"customerId,omitempty"`
+	PropertyID         primitive.ObjectID `json:"propertyId,omitempty" bson:"propertyId,omitempty"`
+	Prices             []OptionPrice      `json:"prices,omitempty" bson:"prices,omitempty"`
+	DeletedAt          *time.Time         `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	DeletedBy          string             `json:"deletedBy,omitempty" bson:"deletedBy,omitempty"`
+	Rev                int                `json:"rev,omitempty" bson:"rev,omitempty"`
+	UpdatedAt          time.Time          `json:"updatedAt" bson:"updatedAt,omitempty"`
+	DrawingNumber      string             `json:"drawingNumber,omitempty" bson:"drawingNumber,omitempty"`
+	Surveyor           string             `json:"surveyor,omitempty" bson:"surveyor,omitempty"`
+
+	// Where QuoteID and DrawingNumber came from; see numbering.go
+	QuoteSeries   string `json:"-" bson:"quoteSeries,omitempty"`
+	QuoteSeq      int    `json:"-" bson:"quoteSeq,omitempty"`
+	DrawingSeries string `json:"-" bson:"drawingSeries,omitempty"`
+	DrawingSeq    int    `json:"-" bson:"drawingSeq,omitempty"`
 }
 
+// Job options as offered by the client. A job may quote for several.
+const (
+	OptionNewWindows = "New Windows"
+	OptionRefurb     = "Refurb"
+	OptionPVC        = "PVC"
+)
+
 type User struct {
 	ID       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	Username string             `json:"username" bson:"username"`
 	Email    string             `json:"email" bson:"email"`
 	Password string             `json:"password" bson:"password"`
+	Role     string             `json:"role,omitempty" bson:"role,omitempty"`
+
+	CalendarToken string `json:"-" bson:"calendarToken,omitempty"`
+	CalendarTeam  string `json:"calendarTeam,omitempty" bson:"calendarTeam,omitempty"`
 }
 
 type Counter struct {
@@ -102,51 +130,141 @@ type Counter struct {
 	Seq int    `bson:"seq"`
 }
 
+// Temp is the metadata of an uploaded image; the bytes live in the blob
+// store under BlobKey. Uploading again under the same name adds a new
+// version rather than replacing the old one. Temps from before versions
+// were introduced have none and count as the oldest.
 type Temp struct {
-	ID       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name     string             `json:"name" bson:"name"`
-	Image    []byte             `json:"image" bson:"image"`
-	FileType string             `json:"fileType" bson:"fileType"`
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Version   int                `json:"version" bson:"version,omitempty"`
+	BlobKey   string             `json:"-" bson:"blobKey"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+
+	ImageInfo `bson:",inline"`
 }
 
 // Global Variables
 
 var (
-	jobCollection      *mongo.Collection
-	userCollection     *mongo.Collection
-	countersCollection *mongo.Collection
-	tempsCollection    *mongo.Collection
-	drawingCollection  *mongo.Collection
-	jwtSecret          string
-	tokenExpiryTime    = time.Hour * 1000000
+	database                  *mongo.Database
+	jobCollection             *mongo.Collection
+	userCollection            *mongo.Collection
+	countersCollection        *mongo.Collection
+	tempsCollection           *mongo.Collection
+	drawingCollection         *mongo.Collection
+	auditCollection           *mongo.Collection
+	customerCollection        *mongo.Collection
+	propertyCollection        *mongo.Collection
+	scheduleCollection        *mongo.Collection
+	settingsCollection        *mongo.Collection
+	costCollection            *mongo.Collection
+	migrationCollection       *mongo.Collection
+	photoCollection           *mongo.Collection
+	idempotencyCollection     *mongo.Collection
+	webhookCollection         *mongo.Collection
+	webhookDeliveryCollection *mongo.Collection
+	lockCollection            *mongo.Collection
+	blobs                     blob.Store
+	jwtSecret                 string
+	tokenExpiryTime           = time.Hour * 1000000
+	trashRetention            = time.Hour * 24 * 30
+	maxUploadBytes            = int64(25 << 20)
+	serverPort                string
+	allowOrigins              string
 )
 
 // JWT Claims Structure
 
 type Claims struct {
 	Email string `json:"email"`
+	Role  string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// currentClaims returns the claims of the authenticated user, or nil when the
+// request did not pass through the JWT middleware.
+func currentClaims(c *fiber.Ctx) *Claims {
+	token, ok := c.Locals("user").(*jwt.Token)
+	if !ok {
+		return nil
+	}
+	claims, _ := token.Claims.(*Claims)
+	return claims
+}
+
+func currentUserEmail(c *fiber.Ctx) string {
+	if claims := currentClaims(c); claims != nil {
+		return claims.Email
+	}
+	return ""
+}
+
 // Main Function
 
 func main() {
 	_ = godotenv.Load()
 	MONGODB_URI := os.Getenv("MONGODB_URI")
-	PORT := os.Getenv("PORT")
-	if PORT == "" {
-		PORT = "5000"
+	serverPort = os.Getenv("PORT")
+	if serverPort == "" {
+		serverPort = "5000"
 	}
 	jwtSecret = os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET not set")
 	}
 
-	allowOrigins := os.Getenv("ALLOW_ORIGINS")
+	allowOrigins = os.Getenv("ALLOW_ORIGINS")
 	if allowOrigins == "" {
 		allowOrigins = "http://localhost:5173"
 	}
 
+	if mb := os.Getenv("MAX_UPLOAD_MB"); mb != "" {
+		n, err := strconv.Atoi(mb)
+		if err != nil || n <= 0 {
+			log.Fatal("Invalid MAX_UPLOAD_MB: ", mb)
+		}
+		maxUploadBytes = int64(n) << 20
+	}
+
+	if seconds := os.Getenv("WATCH_POLL_SECONDS"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n <= 0 {
+			log.Fatal("Invalid WATCH_POLL_SECONDS: ", seconds)
+		}
+		watchPollInterval = time.Second * time.Duration(n)
+	}
+
+	if days := os.Getenv("TRASH_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			log.Fatal("Invalid TRASH_RETENTION_DAYS: ", err)
+		}
+		trashRetention = time.Hour * 24 * time.Duration(n)
+	}
+
+	for env, sequence := range map[string]*NumberSequence{
+		"QUOTE_NUMBER_FORMAT":   quoteNumbers,
+		"DRAWING_NUMBER_FORMAT": drawingNumbers,
+		"INVOICE_NUMBER_FORMAT": invoiceNumbers,
+	} {
+		if format := os.Getenv(env); format != "" {
+			if err := sequence.setNumberFormat(format); err != nil {
+				log.Fatal("Invalid ", env, ": ", err)
+			}
+		}
+	}
+
+	name, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		printUsage()
+		os.Exit(2)
+	}
+
 	clientOptions := options.Client().ApplyURI(MONGODB_URI)
 
 	client, err := mongo.Connect(context.Background(), clientOptions)
@@ -165,27 +283,69 @@ func main() {
 	}
 	fmt.Println("Connected to MongoDB!")
 
+	database = client.Database("quote_db")
 	jobCollection = client.Database("quote_db").Collection("jobs")
 	userCollection = client.Database("quote_db").Collection("users")
 	countersCollection = client.Database("quote_db").Collection("counters")
 	tempsCollection = client.Database("quote_db").Collection("temps")
 	drawingCollection = client.Database("quote_db").Collection("drawings")
+	auditCollection = client.Database("quote_db").Collection("audit_log")
+	customerCollection = client.Database("quote_db").Collection("customers")
+	propertyCollection = client.Database("quote_db").Collection("properties")
+	scheduleCollection = client.Database("quote_db").Collection("schedule")
+	settingsCollection = client.Database("quote_db").Collection("settings")
+	costCollection = client.Database("quote_db").Collection("costs")
+	migrationCollection = client.Database("quote_db").Collection("migrations")
+	photoCollection = client.Database("quote_db").Collection("photos")
+	idempotencyCollection = client.Database("quote_db").Collection("idempotency_keys")
+	webhookCollection = client.Database("quote_db").Collection("webhooks")
+	webhookDeliveryCollection = client.Database("quote_db").Collection("webhook_deliveries")
+	lockCollection = client.Database("quote_db").Collection("locks")
+
+	if err := ensureIndexes(); err != nil {
+		log.Fatal("MongoDB index error: ", err)
+	}
+
+	blobs, err = openBlobStore()
+	if err != nil {
+		log.Fatal("Blob store error: ", err)
+	}
+
+	if err := command.run(args); err != nil {
+		log.Fatal(name+" error: ", err)
+	}
+}
+
+// runServe starts the web server.
+func runServe(args []string) error {
+	if err := awaitMigrations(); err != nil {
+		return err
+	}
 
-	app := fiber.New()
+	go purgeTrashPeriodically(trashRetention)
+	go watchChanges()
+	go deliverWebhooksPeriodically()
+
+	app := fiber.New(fiber.Config{
+		// Room for the other form fields alongside the largest upload
+		BodyLimit:    int(maxUploadBytes) + 1<<20,
+		ErrorHandler: jsonErrorHandler,
+	})
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     allowOrigins,
 		AllowMethods:     "GET, POST, PUT, DELETE, PATCH",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Idempotency-Key",
 		AllowCredentials: true,
 	}))
 
-	app.Static("/", "./client/dist")
+	serveStatic(app)
 	app.Post("/api/register", registerUser)
 	app.Post("/api/login", loginUser)
 
 	app.Use(jwtware.New(jwtware.Config{
 		SigningKey:   []byte(jwtSecret),
+		Claims:       &Claims{},
 		ErrorHandler: jwtError,
 		Filter: func(c *fiber.Ctx) bool {
 			path := c.Path()
@@ -197,13 +357,22 @@ func main() {
 				return true
 			}
 
+			// Calendar feeds authenticate with their own token.
+			if strings.HasPrefix(path, "/api/calendar/feed/") {
+				return true
+			}
+
 			return false
 		},
 	}))
 
+	app.Use(auditLog)
+
 	app.Get("/api/jobs", getJobs)
+	app.Get("/api/jobs/export", exportJobs)
 	app.Get("/api/jobs/:id", getJob)
-	app.Post("/api/jobs", createJob)
+	app.Post("/api/jobs", idempotent, createJob)
+	app.Post("/api/jobs/import", importJobs)
 	app.Put("/api/jobs/:id", updateJob)
 	app.Delete("/api/jobs/:id", deleteJob)
 	app.Post("/api/temps", uploadTempImage)
@@ -215,32 +384,110 @@ func main() {
 	app.Put("/api/drawings/:id", updateDrawing)
 	app.Delete("/api/drawings/:id", deleteDrawing)
 
+	app.Get("/api/sync", getSync)
+	app.Post("/api/sync", postSync)
+
+	app.Get("/api/events", streamEvents)
+	app.Put("/api/presence", setPresence)
+	app.Get("/api/jobs/:id/viewers", getJobViewers)
+	app.Get("/api/drawings/:id/viewers", getDrawingViewers)
+
+	app.Get("/api/trash/jobs", getTrashedJobs)
+	app.Post("/api/trash/jobs/:id/restore", restoreJob)
+	app.Get("/api/trash/drawings", getTrashedDrawings)
+	app.Post("/api/trash/drawings/:id/restore", restoreDrawing)
+
+	app.Get("/api/audit", requireAdmin, getAuditLog)
+
+	app.Get("/api/customers", getCustomers)
+	app.Get("/api/customers/:id", getCustomer)
+	app.Get("/api/customers/:id/jobs", getCustomerJobs)
+	app.Post("/api/customers", createCustomer)
+	app.Post("/api/customers/migrate", requireAdmin, migrateCustomers)
+	app.Put("/api/customers/:id", updateCustomer)
+	app.Delete("/api/customers/:id", deleteCustomer)
+
+	app.Get("/api/properties", getProperties)
+	app.Get("/api/properties/:id", getProperty)
+	app.Get("/api/properties/:id/history", getPropertyHistory)
+	app.Post("/api/properties/migrate", requireAdmin, migrateProperties)
+	app.Put("/api/properties/:id", updateProperty)
+
+	app.Get("/api/schedule", getSchedule)
+	app.Get("/api/schedule/estimate/:drawingId", getFittingEstimate)
+	app.Get("/api/schedule/:id", getBooking)
+	app.Post("/api/schedule", createBooking)
+	app.Put("/api/schedule/:id", updateBooking)
+	app.Delete("/api/schedule/:id", deleteBooking)
+
+	app.Get("/api/jobs/:id/labour", getJobLabour)
+	app.Get("/api/drawings/:id/labour", getDrawingLabour)
+	app.Get("/api/labour/model", getLabourModel)
+	app.Put("/api/labour/model", requireAdmin, updateLabourModel)
+
+	app.Get("/api/jobs/:id/quote", getJobQuote)
+	app.Get("/api/jobs/:id/costs", getJobCosts)
+	app.Post("/api/jobs/:id/costs", addJobCost)
+	app.Get("/api/jobs/:id/margin", getJobMargin)
+	app.Get("/api/drawings/:id/costs", getDrawingCosts)
+	app.Post("/api/drawings/:id/costs", addDrawingCost)
+	app.Get("/api/drawings/:id/margin", getDrawingMargin)
+	app.Delete("/api/costs/:id", deleteCost)
+	app.Get("/api/jobs/:id/photos", getJobPhotos)
+	app.Post("/api/jobs/:id/photos", addJobPhoto)
+	app.Put("/api/jobs/:id/photos/order", reorderJobPhotos)
+	app.Get("/api/drawings/:id/photos", getDrawingPhotos)
+	app.Post("/api/drawings/:id/photos", addDrawingPhoto)
+	app.Put("/api/drawings/:id/photos/order", reorderDrawingPhotos)
+	app.Get("/api/photos/:id/image", getPhotoImage)
+	app.Put("/api/photos/:id", updatePhoto)
+	app.Delete("/api/photos/:id", deletePhoto)
+	app.Get("/api/reports/margins", getMarginReport)
+	app.Get("/api/reports/quotes-per-month", getQuotesPerMonth)
+	app.Get("/api/reports/conversion", getConversionReport)
+	app.Get("/api/reports/value-by-option", getValueByOption)
+	app.Get("/api/reports/value-by-planning", getValueByPlanning)
+	app.Get("/api/reports/top-postcodes", getTopPostCodes)
+	app.Post("/api/reports/reprice", requireAdmin, repriceJobs)
+
+	app.Get("/api/webhooks", requireAdmin, getWebhooks)
+	app.Post("/api/webhooks", requireAdmin, createWebhook)
+	app.Put("/api/webhooks/:id", requireAdmin, updateWebhook)
+	app.Delete("/api/webhooks/:id", requireAdmin, deleteWebhook)
+	app.Post("/api/webhooks/:id/ping", requireAdmin, pingWebhook)
+	app.Get("/api/webhooks/:id/deliveries", requireAdmin, getWebhookDeliveries)
+	app.Post("/api/webhooks/deliveries/:id/replay", requireAdmin, replayDelivery)
+
+	app.Get("/api/calendar/feed/:token.ics", getCalendarFeed)
+	app.Post("/api/calendar/token", createCalendarToken)
+	app.Delete("/api/calendar/token", deleteCalendarToken)
+
 	app.Use(func(c *fiber.Ctx) error {
 		if c.Path() == "/api" || strings.HasPrefix(c.Path(), "/api/") {
 			return c.Next()
 		}
-		return c.SendFile("./client/dist/index.html")
+		return sendIndex(c)
 	})
 
-	log.Fatal(app.Listen("0.0.0.0:" + PORT))
+	return app.Listen("0.0.0.0:" + serverPort)
 }
 
-// Handler Functions
-
-func getNextSequenceNumber(name string) (int, error) {
-	filter := bson.M{"_id": name}
-	update := bson.M{"$inc": bson.M{"seq": 1}}
-	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
-
-	var counter Counter
-	err := countersCollection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&counter)
-	if err != nil {
-		return 0, err
+// jsonErrorHandler reports errors Fiber raises itself, such as an
+// oversized body, in the same {"error": ...} shape as the handlers.
+func jsonErrorHandler(c *fiber.Ctx, err error) error {
+	code := fiber.StatusInternalServerError
+	message := "Internal server error"
+	if ferr, ok := err.(*fiber.Error); ok {
+		code, message = ferr.Code, ferr.Message
 	}
-
-	return counter.Seq, nil
+	return c.Status(code).JSON(fiber.Map{
+		"error": message,
+	})
 }
 
+
+// Handler Functions
+
 func registerUser(c *fiber.Ctx) error {
 	type Request struct {
 		Username string `json:"username"`
@@ -344,6 +591,7 @@ func loginUser(c *fiber.Ctx) error {
 	expirationTime := time.Now().Add(tokenExpiryTime)
 	claims := &Claims{
 		Email: user.Email,
+		Role:  user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -366,6 +614,17 @@ func loginUser(c *fiber.Ctx) error {
 	})
 }
 
+// requireAdmin rejects requests from users without the admin role.
+func requireAdmin(c *fiber.Ctx) error {
+	claims := currentClaims(c)
+	if claims == nil || claims.Role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Admin access required",
+		})
+	}
+	return c.Next()
+}
+
 func jwtError(c *fiber.Ctx, err error) error {
 	if err.Error() == "Missing or malformed JWT" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -377,9 +636,80 @@ func jwtError(c *fiber.Ctx, err error) error {
 	})
 }
 
+// quoteDateRange builds the condition on a job's quote date from the from
+// and to query parameters (inclusive, YYYY-MM-DD or YYYY-MM), or returns
+// nil if neither is given.
+func quoteDateRange(c *fiber.Ctx) bson.M {
+	date := bson.M{}
+	if from := c.Query("from"); from != "" {
+		date["$gte"] = from
+	}
+	if to := c.Query("to"); to != "" {
+		// "~" sorts after any digit, so a month bound includes all its days.
+		date["$lte"] = to + "~"
+	}
+	if len(date) == 0 {
+		return nil
+	}
+	return date
+}
+
+// jobListFilter builds the filter for the job list from the query string:
+// q searches customer, address and postcode; completed, option, customerId
+// and propertyId match exactly; from and to bound the quote date.
+func jobListFilter(c *fiber.Ctx) (bson.M, error) {
+	filter := notDeleted(bson.M{})
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+		filter["$or"] = []bson.M{
+			{"quoteId": q},
+			{"customerName": pattern},
+			{"email": pattern},
+			{"address": pattern},
+			{"addressLineOne": pattern},
+			{"addressLineTwo": pattern},
+			{"addressLineThree": pattern},
+			{"postCode": pattern},
+		}
+	}
+	if completed := c.Query("completed"); completed != "" {
+		value, err := strconv.ParseBool(completed)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid completed value")
+		}
+		filter["completed"] = value
+	}
+	if option := c.Query("option"); option != "" {
+		filter["options"] = option
+	}
+	for param, field := range map[string]string{"customerId": "customerId", "propertyId": "propertyId"} {
+		if value := c.Query(param); value != "" {
+			objID, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+param)
+			}
+			filter[field] = objID
+		}
+	}
+
+	if date := quoteDateRange(c); date != nil {
+		filter["date"] = date
+	}
+
+	return filter, nil
+}
+
 func getJobs(c *fiber.Ctx) error {
+	filter, err := jobListFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	var jobs []Job
-	cursor, err := jobCollection.Find(context.Background(), bson.M{})
+	cursor, err := jobCollection.Find(context.Background(), filter)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Database error",
@@ -409,7 +739,7 @@ func getJob(c *fiber.Ctx) error {
 		})
 	}
 
-	filter := bson.M{"_id": objID}
+	filter := notDeleted(bson.M{"_id": objID})
 	var job Job
 	err = jobCollection.FindOne(context.Background(), filter).Decode(&job)
 	if err != nil {
@@ -421,9 +751,52 @@ func getJob(c *fiber.Ctx) error {
 	return c.JSON(job)
 }
 
-func createJob(c *fiber.Ctx) error {
-	collection := jobCollection
+// prepareJob normalises a new job and fills in everything derived from it
+// on the server: its customer, property and prices.
+func prepareJob(job *Job) *fiber.Error {
+	if err := normaliseJobAddress(job); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if err := linkJobCustomer(job); err != nil {
+		if err == errCustomerNotFound {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to link customer")
+	}
+
+	if err := linkJobProperty(job); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to link property")
+	}
 
+	foldLegacyRoomFields(job)
+	assignRoomIDs(job, nil)
+	job.Prices = jobPrices(job)
+	return nil
+}
+
+// insertJob gives a prepared job the next quote number and saves it. A job
+// with an ID already set, such as one created offline, keeps it.
+func insertJob(job *Job) *fiber.Error {
+	job.Rev = 1
+	job.UpdatedAt = time.Now()
+
+	var result *mongo.InsertOneResult
+	_, err := quoteNumbers.insertNumbered(jobOptionCode(job), func(n Number) error {
+		job.QuoteID, job.QuoteSeries, job.QuoteSeq = n.Value, n.Series, n.Seq
+		var err error
+		result, err = jobCollection.InsertOne(context.Background(), job)
+		return err
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	job.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func createJob(c *fiber.Ctx) error {
 	var job Job
 
 	if err := c.BodyParser(&job); err != nil {
@@ -432,27 +805,42 @@ func createJob(c *fiber.Ctx) error {
 		})
 	}
 
-	seq, err := getNextSequenceNumber("quoteId")
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate quote ID",
-		})
+	// The survey is the creator's unless the client assigns it
+	if job.Surveyor == "" {
+		job.Surveyor = currentUserEmail(c)
 	}
 
-	job.QuoteID = strconv.Itoa(seq)
-
-	result, err := collection.InsertOne(c.Context(), job)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
+	if ferr := prepareJob(&job); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
 		})
 	}
 
-	job.ID = result.InsertedID.(primitive.ObjectID)
+	if ferr := insertJob(&job); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
 
 	return c.Status(fiber.StatusCreated).JSON(job)
 }
 
+// prepareJobUpdate normalises an edited job or drawing and returns the
+// update that saves it as the next revision. stored is the rooms as saved
+// before the edit.
+func prepareJobUpdate(job *Job, stored []Room) (bson.M, *fiber.Error) {
+	if err := normaliseJobAddress(job); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	foldLegacyRoomFields(job)
+	assignRoomIDs(job, stored)
+	job.Prices = jobPrices(job)
+
+	job.Rev = 0
+	job.UpdatedAt = time.Now()
+	return bson.M{"$set": job, "$inc": bson.M{"rev": 1}}, nil
+}
+
 func updateJob(c *fiber.Ctx) error {
 	id := c.Params("id")
 	objID, err := primitive.ObjectIDFromHex(id)
@@ -469,16 +857,41 @@ func updateJob(c *fiber.Ctx) error {
 		})
 	}
 
-	filter := bson.M{"_id": objID}
-	update := bson.M{"$set": job}
+	stored, err := storedRooms(jobCollection, objID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	update, ferr := prepareJobUpdate(job, stored)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	filter := notDeleted(bson.M{"_id": objID})
 
-	_, err = jobCollection.UpdateOne(context.Background(), filter, update)
+	result, err := jobCollection.UpdateOne(context.Background(), filter, update)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Could not update job",
 		})
 	}
 
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
+
+	if err := reattachPhotos("job", objID, job.Rooms); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update photos",
+		})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Job updated"})
 }
 
@@ -491,15 +904,14 @@ func deleteJob(c *fiber.Ctx) error {
 		})
 	}
 
-	filter := bson.M{"_id": objID}
-	result, err := jobCollection.DeleteOne(context.Background(), filter)
+	result, err := softDelete(jobCollection, objID, currentUserEmail(c))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Could not delete job",
 		})
 	}
 
-	if result.DeletedCount == 0 {
+	if result.MatchedCount == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Job not found",
 		})
@@ -516,42 +928,49 @@ func uploadTempImage(c *fiber.Ctx) error {
 		})
 	}
 
-	fileHeader, err := c.FormFile("image")
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Image file is required",
+	file, ferr := openUpload(c, "image")
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
 		})
 	}
+	defer file.Close()
 
-	file, err := fileHeader.Open()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to open uploaded file",
-		})
+	temp := Temp{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		CreatedAt: time.Now(),
 	}
-	defer file.Close()
+	temp.BlobKey = tempBlobKey(temp.ID)
 
-	imageData, err := ioutil.ReadAll(file)
+	info, _, err := storeImage(c.Context(), temp.BlobKey, file)
+	if ferr := imageError(err); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read file content",
+			"error": "Failed to save image",
 		})
 	}
+	temp.ImageInfo = info
 
-	temp := Temp{
-		Name:     name,
-		Image:    imageData,
-		FileType: fileHeader.Header.Get("Content-Type"),
-	}
-
-	result, err := tempsCollection.InsertOne(context.Background(), temp)
-	if err != nil {
+	if err := insertTempVersion(&temp); err != nil {
+		deleteImage(context.Background(), temp.BlobKey, temp.ImageInfo)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to save image",
 		})
 	}
 
-	temp.ID = result.InsertedID.(primitive.ObjectID)
+	// overwrite=true keeps only the version just uploaded
+	if c.FormValue("overwrite") == "true" {
+		if err := deleteTempVersions(name, temp.Version); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to remove previous versions",
+			})
+		}
+	}
 
 	return c.Status(fiber.StatusCreated).JSON(temp)
 }
@@ -564,16 +983,26 @@ func getTempImage(c *fiber.Ctx) error {
 		})
 	}
 
+	// The latest version unless ?version= asks for an older one
+	filter := bson.M{"name": name}
+	version := c.QueryInt("version")
+	if version > 0 {
+		filter["version"] = version
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}, {Key: "_id", Value: -1}})
+
 	var temp Temp
-	err := tempsCollection.FindOne(context.Background(), bson.M{"name": name}).Decode(&temp)
+	err := tempsCollection.FindOne(context.Background(), filter, opts).Decode(&temp)
 	if err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Image not found",
 		})
 	}
 
-	c.Set("Content-Type", temp.FileType)
-	return c.Send(temp.Image)
+	// A temp fetched by name may be replaced by a newer version; a given
+	// version never changes. A version that is not a positive number was
+	// ignored above, so the latest was served and must be revalidated.
+	return sendImage(c, temp.BlobKey, temp.ImageInfo, temp.CreatedAt, version > 0)
 }
 
 
@@ -590,18 +1019,27 @@ func convertJobToDrawing(c *fiber.Ctx) error {
 
     // Find the job
     var job Job
-    err = jobCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&job)
+    err = jobCollection.FindOne(context.Background(), notDeleted(bson.M{"_id": objID})).Decode(&job)
     if err != nil {
         return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
             "error": "Job not found",
         })
     }
 
-    // Reset ID so MongoDB assigns a new one in the drawings collection
+    // Reset ID so MongoDB assigns a new one in the drawings collection,
+    // and start the drawing's own revision history
     job.ID = primitive.NilObjectID
-
-    // Insert into drawings collection
-    result, err := drawingCollection.InsertOne(context.Background(), job)
+    job.Rev = 1
+    job.UpdatedAt = time.Now()
+
+    // Insert into drawings collection under the next drawing number
+    var result *mongo.InsertOneResult
+    _, err = drawingNumbers.insertNumbered(jobOptionCode(&job), func(n Number) error {
+        job.DrawingNumber, job.DrawingSeries, job.DrawingSeq = n.Value, n.Series, n.Seq
+        var err error
+        result, err = drawingCollection.InsertOne(context.Background(), job)
+        return err
+    })
     if err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
             "error": "Failed to create drawing",
@@ -610,13 +1048,20 @@ func convertJobToDrawing(c *fiber.Ctx) error {
 
     job.ID = result.InsertedID.(primitive.ObjectID)
 
+    // Survey photos carry over, sharing the job's images
+    if err := copyPhotos("job", objID, "drawing", job.ID); err != nil {
+        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": "Failed to copy photos",
+        })
+    }
+
     // Return the drawing document (same shape as Job)
     return c.Status(fiber.StatusCreated).JSON(job)
 }
 
 func getDrawings(c *fiber.Ctx) error {
     var drawings []Job
-    cursor, err := drawingCollection.Find(context.Background(), bson.M{})
+    cursor, err := drawingCollection.Find(context.Background(), notDeleted(bson.M{}))
     if err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
             "error": "Database error",
@@ -647,7 +1092,7 @@ func getDrawing(c *fiber.Ctx) error {
     }
 
     var drawing Job
-    err = drawingCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&drawing)
+    err = drawingCollection.FindOne(context.Background(), notDeleted(bson.M{"_id": objID})).Decode(&drawing)
     if err != nil {
         return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
             "error": "Drawing not found",
@@ -673,16 +1118,41 @@ func updateDrawing(c *fiber.Ctx) error {
         })
     }
 
-    filter := bson.M{"_id": objID}
-    update := bson.M{"$set": drawing}
+    stored, err := storedRooms(drawingCollection, objID)
+    if err != nil {
+        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": "Database error",
+        })
+    }
+
+    update, ferr := prepareJobUpdate(drawing, stored)
+    if ferr != nil {
+        return c.Status(ferr.Code).JSON(fiber.Map{
+            "error": ferr.Message,
+        })
+    }
 
-    _, err = drawingCollection.UpdateOne(context.Background(), filter, update)
+    filter := notDeleted(bson.M{"_id": objID})
+
+    result, err := drawingCollection.UpdateOne(context.Background(), filter, update)
     if err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
             "error": "Could not update drawing",
         })
     }
 
+    if result.MatchedCount == 0 {
+        return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Drawing not found",
+        })
+    }
+
+    if err := reattachPhotos("drawing", objID, drawing.Rooms); err != nil {
+        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": "Failed to update photos",
+        })
+    }
+
     return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Drawing updated"})
 }
 
@@ -695,15 +1165,14 @@ func deleteDrawing(c *fiber.Ctx) error {
         })
     }
 
-    filter := bson.M{"_id": objID}
-    result, err := drawingCollection.DeleteOne(context.Background(), filter)
+    result, err := softDelete(drawingCollection, objID, currentUserEmail(c))
     if err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
             "error": "Could not delete drawing",
         })
     }
 
-    if result.DeletedCount == 0 {
+    if result.MatchedCount == 0 {
         return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
             "error": "Drawing not found",
         })
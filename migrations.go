@@ -0,0 +1,539 @@
+// migrations.go
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is one versioned change to the stored data. Versions are
+// applied in ascending order and each is recorded in the migrations
+// collection once it has run, so it never runs twice. Up must be safe to
+// re-run after a partial failure or a crash, including over a run that
+// another server abandoned part way: each migration only touches documents
+// still in the old shape.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func() error
+}
+
+// MigrationRecord is the document stored for an applied (or running)
+// migration. AppliedAt stays nil until Up has finished; HeartbeatAt is
+// renewed while it runs.
+type MigrationRecord struct {
+	Version     int        `json:"version" bson:"_id"`
+	Name        string     `json:"name" bson:"name"`
+	StartedAt   time.Time  `json:"startedAt" bson:"startedAt"`
+	HeartbeatAt time.Time  `json:"heartbeatAt" bson:"heartbeatAt,omitempty"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+}
+
+// lastSeen is when the server running the migration was last known to be
+// alive. Records written before heartbeats only have StartedAt.
+func (r *MigrationRecord) lastSeen() time.Time {
+	if r.HeartbeatAt.IsZero() {
+		return r.StartedAt
+	}
+	return r.HeartbeatAt
+}
+
+// migrations must stay in version order. Never renumber or remove an entry
+// once it has shipped; add a new one instead.
+var migrations = []Migration{
+	{1, "camel-case job fields", migrateCamelCaseFields},
+	{2, "fold legacy room fields", migrateLegacyRoomFields},
+	{3, "move temp images to blob store", migrateTempsToBlobStore},
+	{4, "add revisions for sync", migrateRevisions},
+	{5, "give rooms IDs for photos", migrateRoomIDs},
+	{6, "assign surveys to their creators", migrateSurveyors},
+}
+
+var errMigrationRunning = errors.New("migration already in progress")
+
+// A running migration renews its heartbeat every migrationHeartbeat. One
+// whose heartbeat is older than migrationStale belongs to a server that
+// died, and the next run takes it over; "migrate -unlock" releases one
+// sooner. Servers starting while another applies a migration check back
+// every migrationWait.
+const (
+	migrationHeartbeat = 30 * time.Second
+	migrationStale     = 5 * time.Minute
+	migrationWait      = 10 * time.Second
+)
+
+// appliedMigrations returns the recorded migrations keyed by version.
+func appliedMigrations() (map[int]MigrationRecord, error) {
+	cursor, err := migrationCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var records []MigrationRecord
+	if err := cursor.All(context.Background(), &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]MigrationRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// claimMigration records m as running and returns its start time, which
+// identifies this run. A record whose heartbeat has gone stale is taken
+// over; the update only matches if nobody else has taken it over since it
+// was read.
+func claimMigration(m Migration, existing *MigrationRecord) (time.Time, error) {
+	now := time.Now()
+	if existing == nil {
+		record := MigrationRecord{Version: m.Version, Name: m.Name, StartedAt: now, HeartbeatAt: now}
+		_, err := migrationCollection.InsertOne(context.Background(), record)
+		if mongo.IsDuplicateKeyError(err) {
+			return now, errMigrationRunning
+		}
+		return now, err
+	}
+
+	if time.Since(existing.lastSeen()) < migrationStale {
+		return now, errMigrationRunning
+	}
+	log.Printf("Taking over migration %d, not heard from since %s\n",
+		m.Version, existing.lastSeen().Format(time.RFC3339))
+	result, err := migrationCollection.UpdateOne(context.Background(),
+		bson.M{
+			"_id":       m.Version,
+			"startedAt": existing.StartedAt,
+			"appliedAt": bson.M{"$exists": false},
+		},
+		bson.M{"$set": bson.M{"startedAt": now, "heartbeatAt": now}})
+	if err != nil {
+		return now, err
+	}
+	if result.MatchedCount == 0 {
+		return now, errMigrationRunning
+	}
+	return now, nil
+}
+
+// heartbeat renews the heartbeat of the run of version that started at
+// startedAt until stop is closed.
+func heartbeat(version int, startedAt time.Time, stop <-chan struct{}) {
+	ticker := time.NewTicker(migrationHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_, err := migrationCollection.UpdateOne(context.Background(),
+				bson.M{"_id": version, "startedAt": startedAt},
+				bson.M{"$set": bson.M{"heartbeatAt": time.Now()}})
+			if err != nil {
+				log.Println("Migration heartbeat error:", err)
+			}
+		}
+	}
+}
+
+// runMigrations applies every pending migration in order and returns how
+// many ran. A migration is claimed by inserting its record before it runs,
+// so two servers starting together cannot both apply it; the record is
+// removed again if the migration fails.
+func runMigrations() (int, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	ran := 0
+	for _, m := range migrations {
+		var existing *MigrationRecord
+		if record, ok := applied[m.Version]; ok {
+			if record.AppliedAt != nil {
+				continue
+			}
+			existing = &record
+		}
+
+		startedAt, err := claimMigration(m, existing)
+		if err != nil {
+			return ran, fmt.Errorf("%d %s: %w", m.Version, m.Name, err)
+		}
+
+		log.Printf("Applying migration %d: %s\n", m.Version, m.Name)
+		stop := make(chan struct{})
+		go heartbeat(m.Version, startedAt, stop)
+		err = m.Up()
+		close(stop)
+		if err != nil {
+			migrationCollection.DeleteOne(context.Background(), bson.M{"_id": m.Version})
+			return ran, fmt.Errorf("%d %s: %w", m.Version, m.Name, err)
+		}
+
+		_, err = migrationCollection.UpdateOne(context.Background(),
+			bson.M{"_id": m.Version},
+			bson.M{"$set": bson.M{"appliedAt": time.Now()}})
+		if err != nil {
+			return ran, err
+		}
+		ran++
+	}
+	return ran, nil
+}
+
+// awaitMigrations runs the pending migrations like runMigrations, but while
+// another server is applying one it waits for that to finish, or to go
+// stale, instead of failing. Servers started together by a deploy then
+// all come up once the data is migrated.
+func awaitMigrations() error {
+	for {
+		_, err := runMigrations()
+		if !errors.Is(err, errMigrationRunning) {
+			return err
+		}
+		log.Printf("Waiting for migration %v\n", err)
+		time.Sleep(migrationWait)
+	}
+}
+
+// rewriteRooms calls fn on the rooms of every job and drawing matching
+// filter, along with the document's ID, and saves the result when fn
+// reports a change. Rooms are handled as raw documents so fields no longer
+// in the Room struct can be read. A saved document gets a new revision, so
+// that sync clients pull it.
+func rewriteRooms(filter bson.M, fn func(id primitive.ObjectID, room bson.M) bool) error {
+	for _, collection := range []*mongo.Collection{jobCollection, drawingCollection} {
+		opts := options.Find().SetProjection(bson.M{"rooms": 1})
+		cursor, err := collection.Find(context.Background(), filter, opts)
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(context.Background()) {
+			var doc struct {
+				ID    primitive.ObjectID `bson:"_id"`
+				Rooms []bson.M           `bson:"rooms"`
+			}
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			changed := false
+			for _, room := range doc.Rooms {
+				if fn(doc.ID, room) {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+
+			_, err := collection.UpdateOne(context.Background(),
+				bson.M{"_id": doc.ID},
+				revised(bson.M{"rooms": doc.Rooms}))
+			if err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+		}
+
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateCamelCaseFields renames the lowercase customername, postcode and
+// rooms.roomname fields to match the camelCase used everywhere else. Where
+// a document already has the camelCase field, that is the newer value and
+// the lowercase one is dropped; documents already converted are left
+// alone, so a re-run only finishes what an earlier run did not.
+func migrateCamelCaseFields() error {
+	renames := map[string]string{
+		"customername": "customerName",
+		"postcode":     "postCode",
+	}
+	for _, collection := range []*mongo.Collection{jobCollection, drawingCollection} {
+		for from, to := range renames {
+			_, err := collection.UpdateMany(context.Background(),
+				bson.M{from: bson.M{"$exists": true}, to: bson.M{"$exists": false}},
+				bson.M{"$rename": bson.M{from: to}})
+			if err != nil {
+				return err
+			}
+			_, err = collection.UpdateMany(context.Background(),
+				bson.M{from: bson.M{"$exists": true}},
+				bson.M{"$unset": bson.M{from: ""}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// $rename cannot reach into arrays, so rooms are rewritten one by one.
+	return rewriteRooms(bson.M{"rooms.roomname": bson.M{"$exists": true}}, func(_ primitive.ObjectID, room bson.M) bool {
+		name, ok := room["roomname"]
+		if !ok {
+			return false
+		}
+		if _, ok := room["roomName"]; !ok {
+			room["roomName"] = name
+		}
+		delete(room, "roomname")
+		return true
+	})
+}
+
+// migrateLegacyRoomFields folds the old EC flag into EasyClean and the old
+// numeric PriceChange into PriceChange2, then drops the old fields. Rooms
+// without the old fields are left alone, so it is safe to re-run.
+//
+// PriceChange only moves into an empty PriceChange2. The PDFs disagree on
+// a PriceChange2 of "0": RefurbPDF reads it as 0% while NewWindowsPDF falls
+// back to the old PriceChange. Such rooms keep "0", which leaves Refurb
+// quotes as they were, and are logged so that any New Windows quote they
+// change can be checked by hand.
+func migrateLegacyRoomFields() error {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"rooms.eC": bson.M{"$exists": true}},
+		bson.M{"rooms.priceChange": bson.M{"$exists": true}},
+	}}
+	return rewriteRooms(filter, func(id primitive.ObjectID, room bson.M) bool {
+		changed := false
+
+		if ec, ok := room["eC"]; ok {
+			if ec == true {
+				room["easyClean"] = true
+			}
+			delete(room, "eC")
+			changed = true
+		}
+
+		if pc, ok := room["priceChange"]; ok {
+			current, _ := room["priceChange2"].(string)
+			change := legacyPriceChange(pc)
+			switch {
+			case change != 0 && current == "":
+				room["priceChange2"] = strconv.FormatFloat(change, 'f', -1, 64)
+			case change != 0 && current == "0":
+				log.Printf("Room %q of %s: kept priceChange2 \"0\", dropped priceChange %v that New Windows quotes used\n",
+					room["ref"], id.Hex(), change)
+			}
+			delete(room, "priceChange")
+			changed = true
+		}
+
+		return changed
+	})
+}
+
+// legacyPriceChange reads the old priceChange value, which was stored as
+// whichever numeric type the client happened to send.
+func legacyPriceChange(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return 0
+}
+
+// foldLegacyRoomFields applies the same folding as migration 2 to a job
+// being written, since older clients still send eC and priceChange.
+// PriceChange2 is the newer field, so any value in it, "0" included, wins.
+func foldLegacyRoomFields(job *Job) {
+	for i := range job.Rooms {
+		room := &job.Rooms[i]
+		if room.EC {
+			room.EasyClean = true
+			room.EC = false
+		}
+		if room.PriceChange != 0 {
+			if room.PriceChange2 == "" {
+				room.PriceChange2 = strconv.FormatFloat(room.PriceChange, 'f', -1, 64)
+			}
+			room.PriceChange = 0
+		}
+	}
+}
+
+// migrateRevisions gives every job and drawing written before sync existed
+// a first rev, dated from its ObjectID. Documents that already have an
+// updatedAt are skipped, so it is safe to re-run.
+func migrateRevisions() error {
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"updatedAt": bson.M{"$toDate": "$_id"},
+			"rev":       1,
+		}}},
+	}
+	for _, collection := range []*mongo.Collection{jobCollection, drawingCollection} {
+		_, err := collection.UpdateMany(context.Background(),
+			bson.M{"updatedAt": bson.M{"$exists": false}}, update)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRoomIDs gives every room a roomId and records it on the photos of
+// that room, so that photos can follow their room when rooms are reordered
+// or removed. A photo whose room index is already past the end of the rooms
+// becomes a photo of the whole property. Rooms and photos that already
+// have a roomId are left alone, so it is safe to re-run.
+func migrateRoomIDs() error {
+	err := rewriteRooms(bson.M{"rooms": bson.M{"$elemMatch": bson.M{"roomId": bson.M{"$exists": false}}}},
+		func(_ primitive.ObjectID, room bson.M) bool {
+			if _, ok := room["roomId"]; ok {
+				return false
+			}
+			room["roomId"] = primitive.NewObjectID().Hex()
+			return true
+		})
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"room": bson.M{"$ne": nil}, "roomId": bson.M{"$exists": false}}
+	cursor, err := photoCollection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	targets := map[string]*Job{}
+	for cursor.Next(context.Background()) {
+		var photo Photo
+		if err := cursor.Decode(&photo); err != nil {
+			return err
+		}
+
+		key := viewTarget(photo.TargetType, photo.TargetID.Hex())
+		job, ok := targets[key]
+		if !ok {
+			job = &Job{}
+			err := targetCollection(photo.TargetType).FindOne(context.Background(), bson.M{"_id": photo.TargetID}).Decode(job)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			targets[key] = job
+		}
+
+		update := bson.M{"$set": bson.M{"room": nil}}
+		if room := *photo.Room; room >= 0 && room < len(job.Rooms) {
+			update = bson.M{"$set": bson.M{"roomId": job.Rooms[room].RoomID}}
+		}
+		if _, err := photoCollection.UpdateOne(context.Background(), bson.M{"_id": photo.ID}, update); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// migrateSurveyors assigns jobs created since the audit log began to the
+// user who created them, so that they appear in that user's calendar feed.
+// Older jobs stay unassigned until someone sets their surveyor. Jobs that
+// already have a surveyor are left alone, so it is safe to re-run.
+func migrateSurveyors() error {
+	filter := bson.M{
+		"collection": jobCollection.Name(),
+		"status":     fiber.StatusCreated,
+		"before":     bson.M{"$exists": false},
+		"targetId":   bson.M{"$exists": true},
+		"user":       bson.M{"$ne": ""},
+	}
+	cursor, err := auditCollection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		objID, err := primitive.ObjectIDFromHex(entry.TargetID)
+		if err != nil {
+			continue
+		}
+		_, err = jobCollection.UpdateOne(context.Background(),
+			bson.M{"_id": objID, "surveyor": bson.M{"$exists": false}},
+			revised(bson.M{"surveyor": entry.User}))
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// runMigrate implements "migrate [-status] [-unlock <version>]".
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "list migrations without applying any")
+	unlock := flags.Int("unlock", 0, "release an unfinished migration left by a server that died")
+	flags.Parse(args)
+
+	if *unlock != 0 {
+		result, err := migrationCollection.DeleteOne(context.Background(), bson.M{
+			"_id":       *unlock,
+			"appliedAt": bson.M{"$exists": false},
+		})
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			return fmt.Errorf("migration %d is not running", *unlock)
+		}
+		fmt.Printf("Released migration %d\n", *unlock)
+		return nil
+	}
+
+	if *status {
+		applied, err := appliedMigrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if record, ok := applied[m.Version]; ok {
+				state = "running since " + record.StartedAt.Format(time.RFC3339) +
+					", last heartbeat " + record.lastSeen().Format(time.RFC3339)
+				if record.AppliedAt != nil {
+					state = "applied " + record.AppliedAt.Format(time.RFC3339)
+				}
+			}
+			fmt.Printf("%4d  %-30s %s\n", m.Version, m.Name, state)
+		}
+		return nil
+	}
+
+	ran, err := runMigrations()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d migrations\n", ran)
+	return nil
+}
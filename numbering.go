@@ -0,0 +1,275 @@
+// numbering.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Quote, drawing and invoice numbers come from counters in the counters
+// collection. A number is only used up once the document carrying it has
+// been inserted: the candidate is the counter plus one, the document stores
+// its series and sequence number under a unique index, and the counter is
+// moved on after the insert succeeds. If two requests race for a number,
+// or a server died between inserting and moving the counter, the loser
+// hits the unique index and tries the next number. Failed inserts
+// therefore leave no gaps.
+
+// NumberSequence describes one kind of number. Format holds the tokens
+// {seq} or {seq:N} (zero padded to N digits), {year}, {yy} and {option};
+// a format with a year or option token keeps a separate counter for each
+// year or option, so "PW-{year}-{seq:4}" starts again at PW-2027-0001.
+type NumberSequence struct {
+	Counter     string // counter _id, extended with the year and option
+	Format      string
+	SeriesField string
+	SeqField    string
+}
+
+// There are no invoice records yet; their sequence is configured here so
+// that they number from the same counters when they arrive.
+var (
+	quoteNumbers   = &NumberSequence{"quoteId", "{seq}", "quoteSeries", "quoteSeq"}
+	drawingNumbers = &NumberSequence{"drawingId", "D{seq}", "drawingSeries", "drawingSeq"}
+	invoiceNumbers = &NumberSequence{"invoiceId", "INV-{year}-{seq:4}", "invoiceSeries", "invoiceSeq"}
+)
+
+// optionCodes abbreviates a job's first option for {option}.
+var optionCodes = map[string]string{
+	OptionNewWindows: "NW",
+	OptionRefurb:     "RF",
+	OptionPVC:        "PVC",
+}
+
+const noOptionCode = "GEN"
+
+// maxNumberAttempts bounds how many taken numbers are skipped before
+// giving up, which only happens if the counter is far behind.
+const maxNumberAttempts = 100
+
+var numberToken = regexp.MustCompile(`\{([^}]*)\}`)
+
+// Number is an allocated number together with where it came from.
+type Number struct {
+	Value  string
+	Series string
+	Seq    int
+}
+
+// setNumberFormat validates format and makes it the sequence's format.
+func (s *NumberSequence) setNumberFormat(format string) error {
+	hasSeq := false
+	for _, match := range numberToken.FindAllStringSubmatch(format, -1) {
+		token := match[1]
+		switch {
+		case token == "year", token == "yy", token == "option":
+		case token == "seq":
+			hasSeq = true
+		case strings.HasPrefix(token, "seq:"):
+			width, err := strconv.Atoi(strings.TrimPrefix(token, "seq:"))
+			if err != nil || width < 1 || width > 12 {
+				return fmt.Errorf("invalid width in {%s}", token)
+			}
+			hasSeq = true
+		default:
+			return fmt.Errorf("unknown token {%s}", token)
+		}
+	}
+	if !hasSeq {
+		return fmt.Errorf("%q has no {seq}", format)
+	}
+	s.Format = format
+	return nil
+}
+
+// series returns the counter a number issued now for option comes from.
+func (s *NumberSequence) series(now time.Time, option string) string {
+	series := s.Counter
+	if strings.Contains(s.Format, "{year}") || strings.Contains(s.Format, "{yy}") {
+		series += ":" + strconv.Itoa(now.Year())
+	}
+	if strings.Contains(s.Format, "{option}") {
+		series += ":" + option
+	}
+	return series
+}
+
+func (s *NumberSequence) format(seq int, now time.Time, option string) string {
+	return numberToken.ReplaceAllStringFunc(s.Format, func(token string) string {
+		token = strings.Trim(token, "{}")
+		switch {
+		case token == "year":
+			return strconv.Itoa(now.Year())
+		case token == "yy":
+			return fmt.Sprintf("%02d", now.Year()%100)
+		case token == "option":
+			return option
+		case strings.HasPrefix(token, "seq:"):
+			width, _ := strconv.Atoi(strings.TrimPrefix(token, "seq:"))
+			return fmt.Sprintf("%0*d", width, seq)
+		}
+		return strconv.Itoa(seq)
+	})
+}
+
+// jobOptionCode is the {option} value for a job.
+func jobOptionCode(job *Job) string {
+	if len(job.Options) > 0 {
+		if code, ok := optionCodes[job.Options[0]]; ok {
+			return code
+		}
+	}
+	return noOptionCode
+}
+
+// insertNumbered calls insert with successive candidate numbers until one
+// is inserted, then moves the counter up to it. insert must store the
+// number's Series and Seq in the sequence's fields.
+func (s *NumberSequence) insertNumbered(option string, insert func(n Number) error) (Number, error) {
+	now := time.Now()
+	series := s.series(now, option)
+
+	var counter Counter
+	err := countersCollection.FindOne(context.Background(), bson.M{"_id": series}).Decode(&counter)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Number{}, err
+	}
+
+	for seq := counter.Seq + 1; seq <= counter.Seq+maxNumberAttempts; seq++ {
+		n := Number{s.format(seq, now, option), series, seq}
+		err := insert(n)
+		if isDuplicateOf(err, s.SeqField) {
+			continue
+		}
+		if err != nil {
+			return Number{}, err
+		}
+		return n, advanceCounter(series, seq)
+	}
+	return Number{}, fmt.Errorf("no free number in %s after %d", series, counter.Seq)
+}
+
+// isDuplicateOf reports whether err is a duplicate key error on an index
+// that includes field.
+func isDuplicateOf(err error, field string) bool {
+	return err != nil && mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), field)
+}
+
+// advanceCounter moves a counter up to seq; it never moves one back.
+func advanceCounter(series string, seq int) error {
+	_, err := countersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": series},
+		bson.M{"$max": bson.M{"seq": seq}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// numberIndex is the unique index that stops a number being issued twice.
+// Documents numbered before sequences were tracked have no series and are
+// left out.
+func (s *NumberSequence) numberIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: s.SeriesField, Value: 1}, {Key: s.SeqField, Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{s.SeriesField: bson.M{"$exists": true}}),
+	}
+}
+
+// NumberUse is the numbers found in one series. Issued lists the documents
+// each number was issued to; Seen also includes numbers only found copied
+// onto another document, such as a drawing whose job has been purged.
+type NumberUse struct {
+	Issued map[int][]string
+	Seen   map[int]bool
+}
+
+func (use *NumberUse) highest() int {
+	highest := 0
+	for seq := range use.Seen {
+		if seq > highest {
+			highest = seq
+		}
+	}
+	return highest
+}
+
+// usedNumbers collects the numbers on jobs and drawings, including those
+// in the trash, by series. Quotes numbered before series existed count
+// towards the plain quoteId series if their quote ID is numeric; the IDs
+// of jobs whose quote ID is not are returned separately.
+func usedNumbers() (map[string]*NumberUse, []string, error) {
+	used := map[string]*NumberUse{}
+	var invalid []string
+	add := func(series string, seq int, id string, issued bool) {
+		use := used[series]
+		if use == nil {
+			use = &NumberUse{Issued: map[int][]string{}, Seen: map[int]bool{}}
+			used[series] = use
+		}
+		use.Seen[seq] = true
+		if issued {
+			use.Issued[seq] = append(use.Issued[seq], id)
+		}
+	}
+
+	for _, collection := range []*mongo.Collection{jobCollection, drawingCollection} {
+		isJob := collection == jobCollection
+		opts := options.Find().SetProjection(bson.M{
+			"quoteId": 1, "quoteSeries": 1, "quoteSeq": 1, "drawingSeries": 1, "drawingSeq": 1,
+		})
+		cursor, err := collection.Find(context.Background(), bson.M{}, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for cursor.Next(context.Background()) {
+			var job Job
+			if err := cursor.Decode(&job); err != nil {
+				cursor.Close(context.Background())
+				return nil, nil, err
+			}
+
+			// Drawings carry their job's quote number without issuing it.
+			if job.QuoteSeries != "" {
+				add(job.QuoteSeries, job.QuoteSeq, job.ID.Hex(), isJob)
+			} else if n, err := strconv.Atoi(job.QuoteID); err == nil {
+				add(quoteNumbers.Counter, n, job.ID.Hex(), isJob)
+			} else if isJob {
+				invalid = append(invalid, job.ID.Hex())
+			}
+			if job.DrawingSeries != "" {
+				add(job.DrawingSeries, job.DrawingSeq, job.ID.Hex(), true)
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return used, invalid, nil
+}
+
+// resetCounters moves every counter up to the highest number in use, so
+// that restoring an older counters collection alongside newer jobs can
+// never hand out a number twice.
+func resetCounters() error {
+	used, _, err := usedNumbers()
+	if err != nil {
+		return err
+	}
+	for series, use := range used {
+		if err := advanceCounter(series, use.highest()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
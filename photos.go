@@ -0,0 +1,534 @@
+// photos.go
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Site survey photos are attached to a job or drawing and optionally to one
+// of its rooms. Room is the index into the rooms array, which is how clients
+// refer to rooms; a nil Room is a photo of the property as a whole. Photos
+// also keep their room's roomId, so that when a save reorders or removes
+// rooms, reattachPhotos can move each photo to its room's new index, or to
+// the whole property if the room has gone.
+
+type Photo struct {
+	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	TargetType string             `json:"targetType" bson:"targetType"`
+	TargetID   primitive.ObjectID `json:"targetId" bson:"targetId"`
+	Room       *int               `json:"room" bson:"room"`
+	RoomID     string             `json:"-" bson:"roomId,omitempty"`
+	Caption    string             `json:"caption" bson:"caption"`
+	Order      int                `json:"order" bson:"order"`
+	TakenAt    *time.Time         `json:"takenAt,omitempty" bson:"takenAt,omitempty"`
+	BlobKey    string             `json:"-" bson:"blobKey"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	CreatedBy  string             `json:"createdBy" bson:"createdBy"`
+
+	ImageInfo `bson:",inline"`
+}
+
+func photoBlobKey(id primitive.ObjectID) string {
+	return "photos/" + id.Hex()
+}
+
+// parseRoom reads an optional room index and checks it against the job.
+// An empty value means no room.
+func parseRoom(value string, job *Job) (*int, *fiber.Error) {
+	if value == "" {
+		return nil, nil
+	}
+	room, err := strconv.Atoi(value)
+	if err != nil || room < 0 || room >= len(job.Rooms) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid room")
+	}
+	return &room, nil
+}
+
+// assignRoomIDs gives every room that lacks one a roomId. Clients that
+// predate room IDs send rooms without them, so such a room takes the ID of
+// the stored room at the same index, unless another room in the request
+// already claims it; only rooms beyond the stored ones get new IDs. A room
+// sharing its ID with an earlier one was copied from it on the client and
+// is given its own.
+func assignRoomIDs(job *Job, stored []Room) {
+	claimed := map[string]bool{}
+	for _, room := range job.Rooms {
+		if room.RoomID != "" {
+			claimed[room.RoomID] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range job.Rooms {
+		room := &job.Rooms[i]
+		if room.RoomID == "" && i < len(stored) && stored[i].RoomID != "" && !claimed[stored[i].RoomID] {
+			room.RoomID = stored[i].RoomID
+			claimed[room.RoomID] = true
+		}
+		if room.RoomID == "" || seen[room.RoomID] {
+			room.RoomID = primitive.NewObjectID().Hex()
+		}
+		seen[room.RoomID] = true
+	}
+}
+
+// storedRooms returns the rooms of a job or drawing as currently saved, for
+// assignRoomIDs to match an update against. A missing document has none;
+// the update itself reports it as not found.
+func storedRooms(collection *mongo.Collection, id primitive.ObjectID) ([]Room, error) {
+	var stored struct {
+		Rooms []Room `bson:"rooms"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"rooms": 1})
+	err := collection.FindOne(context.Background(), bson.M{"_id": id}, opts).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return stored.Rooms, err
+}
+
+// reattachPhotos moves the photos of a job or drawing whose rooms have just
+// been saved to the new index of their room. Photos of a room that is no
+// longer there become photos of the whole property.
+func reattachPhotos(targetType string, targetID primitive.ObjectID, rooms []Room) error {
+	target := bson.M{"targetType": targetType, "targetId": targetID}
+	ids := bson.A{}
+	var models []mongo.WriteModel
+	for i, room := range rooms {
+		if room.RoomID == "" {
+			continue
+		}
+		ids = append(ids, room.RoomID)
+		filter := bson.M{"roomId": room.RoomID, "room": bson.M{"$ne": i}}
+		for k, v := range target {
+			filter[k] = v
+		}
+		models = append(models, mongo.NewUpdateManyModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{"$set": bson.M{"room": i}}))
+	}
+
+	filter := bson.M{"roomId": bson.M{"$exists": true, "$nin": ids}}
+	for k, v := range target {
+		filter[k] = v
+	}
+	models = append(models, mongo.NewUpdateManyModel().
+		SetFilter(filter).
+		SetUpdate(bson.M{"$set": bson.M{"room": nil}, "$unset": bson.M{"roomId": ""}}))
+
+	_, err := photoCollection.BulkWrite(context.Background(), models)
+	return err
+}
+
+// roomIDAt returns the roomId of the room at index, or "" for none.
+func roomIDAt(job *Job, index *int) string {
+	if index == nil {
+		return ""
+	}
+	return job.Rooms[*index].RoomID
+}
+
+// nextPhotoOrder returns the order for a new photo: after every existing
+// photo of the same job and room.
+func nextPhotoOrder(targetType string, targetID primitive.ObjectID, room *int) (int, error) {
+	filter := bson.M{"targetType": targetType, "targetId": targetID, "room": room}
+	opts := options.FindOne().SetSort(bson.M{"order": -1})
+
+	var last Photo
+	err := photoCollection.FindOne(context.Background(), filter, opts).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return last.Order + 1, nil
+}
+
+func listPhotos(c *fiber.Ctx, targetType string) error {
+	job, ferr := loadTarget(c, targetType)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	filter := bson.M{"targetType": targetType, "targetId": job.ID}
+	if value := c.Query("room"); value != "" {
+		room, ferr := parseRoom(value, job)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(fiber.Map{
+				"error": ferr.Message,
+			})
+		}
+		filter["room"] = room
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "room", Value: 1}, {Key: "order", Value: 1}})
+	cursor, err := photoCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	photos := []Photo{}
+	if err := cursor.All(context.Background(), &photos); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding photo data",
+		})
+	}
+
+	// A room removed by a write that did not go through reattachPhotos,
+	// such as an edit made directly in the database, leaves its photos
+	// pointing past the end of the rooms.
+	for i := range photos {
+		if room := photos[i].Room; room != nil && (*room < 0 || *room >= len(job.Rooms)) {
+			photos[i].Room = nil
+		}
+	}
+
+	return c.JSON(photos)
+}
+
+func addPhoto(c *fiber.Ctx, targetType string) error {
+	job, ferr := loadTarget(c, targetType)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	room, ferr := parseRoom(c.FormValue("room"), job)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	file, ferr := openUpload(c, "image")
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+	defer file.Close()
+
+	order, err := nextPhotoOrder(targetType, job.ID, room)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	photo := Photo{
+		ID:         primitive.NewObjectID(),
+		TargetType: targetType,
+		TargetID:   job.ID,
+		Room:       room,
+		RoomID:     roomIDAt(job, room),
+		Caption:    c.FormValue("caption"),
+		Order:      order,
+		CreatedAt:  time.Now(),
+		CreatedBy:  currentUserEmail(c),
+	}
+	photo.BlobKey = photoBlobKey(photo.ID)
+
+	info, img, err := storeImage(c.Context(), photo.BlobKey, file)
+	if ferr := imageError(err); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save photo",
+		})
+	}
+	photo.ImageInfo = info
+	if img.Exif != nil && !img.Exif.Taken.IsZero() {
+		photo.TakenAt = &img.Exif.Taken
+	}
+
+	if _, err := photoCollection.InsertOne(context.Background(), photo); err != nil {
+		deleteImage(context.Background(), photo.BlobKey, photo.ImageInfo)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save photo",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(photo)
+}
+
+// reorderPhotos sets the order of the given photos to their position in
+// the request. Photos not listed keep their order.
+func reorderPhotos(c *fiber.Ctx, targetType string) error {
+	job, ferr := loadTarget(c, targetType)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var req struct {
+		IDs []primitive.ObjectID `json:"ids"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	for i, id := range req.IDs {
+		filter := bson.M{"_id": id, "targetType": targetType, "targetId": job.ID}
+		result, err := photoCollection.UpdateOne(context.Background(), filter, bson.M{"$set": bson.M{"order": i}})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Could not reorder photos",
+			})
+		}
+		if result.MatchedCount == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Photo " + id.Hex() + " does not belong to this " + targetType,
+			})
+		}
+	}
+
+	return listPhotos(c, targetType)
+}
+
+func findPhoto(c *fiber.Ctx) (*Photo, *fiber.Error) {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+
+	var photo Photo
+	if err := photoCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&photo); err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Photo not found")
+	}
+	return &photo, nil
+}
+
+func getPhotoImage(c *fiber.Ctx) error {
+	photo, ferr := findPhoto(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	return sendImage(c, photo.BlobKey, photo.ImageInfo, photo.CreatedAt, true)
+}
+
+// updatePhoto changes a photo's caption, room or order. Fields left out
+// of the request are unchanged; "room": null moves it to the whole
+// property.
+func updatePhoto(c *fiber.Ctx) error {
+	photo, ferr := findPhoto(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var req map[string]interface{}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	if caption, ok := req["caption"]; ok {
+		s, isString := caption.(string)
+		if !isString {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Caption must be a string",
+			})
+		}
+		set["caption"] = s
+	}
+	if order, ok := req["order"]; ok {
+		n, isNumber := order.(float64)
+		if !isNumber {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Order must be a number",
+			})
+		}
+		set["order"] = int(n)
+	}
+	if room, ok := req["room"]; ok {
+		var job Job
+		err := targetCollection(photo.TargetType).FindOne(context.Background(), bson.M{"_id": photo.TargetID}).Decode(&job)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Job not found",
+			})
+		}
+		value := ""
+		if n, isNumber := room.(float64); isNumber {
+			value = strconv.Itoa(int(n))
+		} else if room != nil {
+			value = "invalid"
+		}
+		index, ferr := parseRoom(value, &job)
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(fiber.Map{
+				"error": ferr.Message,
+			})
+		}
+		set["room"] = index
+		if roomID := roomIDAt(&job, index); roomID != "" {
+			set["roomId"] = roomID
+		} else {
+			unset["roomId"] = ""
+		}
+	}
+
+	if len(set) > 0 {
+		update := bson.M{"$set": set}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		_, err := photoCollection.UpdateOne(context.Background(), bson.M{"_id": photo.ID}, update)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Could not update photo",
+			})
+		}
+	}
+
+	var updated Photo
+	if err := photoCollection.FindOne(context.Background(), bson.M{"_id": photo.ID}).Decode(&updated); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(updated)
+}
+
+// deletePhotoBlob removes a photo's image once no photo record refers to
+// it; a job's photos share their images with the drawing made from it.
+func deletePhotoBlob(photo *Photo) error {
+	count, err := photoCollection.CountDocuments(context.Background(), bson.M{"blobKey": photo.BlobKey})
+	if err != nil || count > 0 {
+		return err
+	}
+	return deleteImage(context.Background(), photo.BlobKey, photo.ImageInfo)
+}
+
+func deletePhoto(c *fiber.Ctx) error {
+	photo, ferr := findPhoto(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	if _, err := photoCollection.DeleteOne(context.Background(), bson.M{"_id": photo.ID}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not delete photo",
+		})
+	}
+	if err := deletePhotoBlob(photo); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not delete photo image",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Photo deleted"})
+}
+
+// deletePhotosOf removes every photo of the given jobs or drawings, used
+// when they are purged from the trash.
+func deletePhotosOf(targetType string, targetIDs []primitive.ObjectID) error {
+	filter := bson.M{"targetType": targetType, "targetId": bson.M{"$in": targetIDs}}
+	cursor, err := photoCollection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var photos []Photo
+	if err := cursor.All(context.Background(), &photos); err != nil {
+		return err
+	}
+
+	if _, err := photoCollection.DeleteMany(context.Background(), filter); err != nil {
+		return err
+	}
+	for i := range photos {
+		if err := deletePhotoBlob(&photos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPhotos attaches copies of a job's photo records to the drawing made
+// from it. The copies share the original images.
+func copyPhotos(fromType string, fromID primitive.ObjectID, toType string, toID primitive.ObjectID) error {
+	cursor, err := photoCollection.Find(context.Background(), bson.M{"targetType": fromType, "targetId": fromID})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var copies []interface{}
+	for cursor.Next(context.Background()) {
+		var photo Photo
+		if err := cursor.Decode(&photo); err != nil {
+			return err
+		}
+		photo.ID = primitive.NewObjectID()
+		photo.TargetType = toType
+		photo.TargetID = toID
+		copies = append(copies, photo)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if len(copies) == 0 {
+		return nil
+	}
+	_, err = photoCollection.InsertMany(context.Background(), copies)
+	return err
+}
+
+func getJobPhotos(c *fiber.Ctx) error {
+	return listPhotos(c, "job")
+}
+
+func addJobPhoto(c *fiber.Ctx) error {
+	return addPhoto(c, "job")
+}
+
+func reorderJobPhotos(c *fiber.Ctx) error {
+	return reorderPhotos(c, "job")
+}
+
+func getDrawingPhotos(c *fiber.Ctx) error {
+	return listPhotos(c, "drawing")
+}
+
+func addDrawingPhoto(c *fiber.Ctx) error {
+	return addPhoto(c, "drawing")
+}
+
+func reorderDrawingPhotos(c *fiber.Ctx) error {
+	return reorderPhotos(c, "drawing")
+}
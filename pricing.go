@@ -0,0 +1,323 @@
+// pricing.go
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Server-side pricing. These mirror the calculations in the client quote
+// PDFs (RefurbPDF, NewWindowsPDF and PVCPDF), including their quirks, so
+// that figures reported by the server match what the customer was sent.
+// The quirks mirrored are noted where they are handled. The one exception
+// was NewWindowsPDF pricing a room with an empty priceChange2 as NaN; the
+// PDF now treats it as no change, as the server always has.
+
+const vatRate = 0.2
+
+var glassTypeCosts = map[string]float64{
+	"Clear":             0,
+	"Toughened":         50,
+	"Obscured":          100,
+	"Laminated":         150,
+	"Fineo":             220,
+	"ToughenedObscured": 150,
+}
+
+var glassPositionMultipliers = map[string]float64{
+	"Both":   2,
+	"Top":    1,
+	"Bottom": 1,
+}
+
+type RoomPrice struct {
+	Ref       string  `json:"ref"`
+	RoomName  string  `json:"roomName"`
+	Windows   int     `json:"windows"`
+	PerWindow float64 `json:"perWindow"`
+	Total     float64 `json:"total"`
+}
+
+type Quote struct {
+	Option      string      `json:"option"`
+	Rooms       []RoomPrice `json:"rooms"`
+	Subtotal    float64     `json:"subtotal"`
+	AdminFee    float64     `json:"adminFee"`
+	PlanningFee float64     `json:"planningFee"`
+	Net         float64     `json:"net"`
+	VAT         float64     `json:"vat"`
+	Total       float64     `json:"total"`
+}
+
+// formationPanes adds up the panes in a formation such as "6/2_side".
+// Placeholder formations count as 1/1.
+func formationPanes(formation string) int {
+	if formation == "placeholder" {
+		formation = "1/1"
+	}
+	formation = strings.Split(formation, "_")[0]
+
+	parts := strings.Split(formation, "/")
+	if len(parts) != 2 {
+		return 0
+	}
+	top, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	bottom, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return top + bottom
+}
+
+// roomPriceChange returns the room's price adjustment as a signed
+// percentage, from PriceChange2 ("10" or "10%"). The older numeric
+// PriceChange is folded into it before rooms are stored.
+func roomPriceChange(room *Room) float64 {
+	change, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(room.PriceChange2), "%"), 64)
+	if err != nil {
+		change = 0
+	}
+	if room.PositiveNegative == "negative" {
+		change = -change
+	}
+	return change
+}
+
+func roomArea(room *Room) float64 {
+	return float64(room.Width) / 1000 * float64(room.Height) / 1000
+}
+
+func casementFactor(room *Room) float64 {
+	if room.Casement {
+		return 0.8
+	}
+	return 1
+}
+
+func refurbPerWindow(room *Room) float64 {
+	main := (roomArea(room)*150 + 300 + float64(formationPanes(room.Formation))*30) *
+		1.28 * (1 + roomPriceChange(room)/100) * casementFactor(room)
+	cost := math.Round(main)
+
+	extras := []struct {
+		set  bool
+		cost float64
+	}{
+		{room.Putty, 20},
+		{room.Tenon, 30},
+		{room.Mastic, 160},
+		{room.MasticPatch, 50},
+		{room.Paint, 160},
+		{room.BottomRail, 160},
+		{room.PullyWheel, 70},
+		{room.EasyClean, 80},
+		{room.OutsidePatch, 50},
+		{room.ConcealedVent, 45},
+		{room.TrickleVent, 32},
+		{room.Handles, 22},
+	}
+	for _, extra := range extras {
+		if extra.set {
+			cost += extra.cost
+		}
+	}
+	if room.CustomItem2 > 0 {
+		cost += float64(room.CustomItem2)
+	}
+
+	switch strings.ToLower(room.Cill) {
+	case "full":
+		cost += 240
+	case "half":
+		cost += 160
+	case "repairs":
+		cost += 70
+	}
+	switch strings.ToLower(room.Sash) {
+	case "top", "bottom":
+		cost += 360
+	case "both":
+		cost += 720
+	}
+
+	cost += float64(room.PanesNumber) * 90
+	cost += float64(room.StainRepairs) * 45
+	return cost
+}
+
+func newWindowsPerWindow(room *Room) float64 {
+	glassType := room.GlassType
+	if glassType == "" {
+		glassType = "Clear"
+	}
+	position := room.GlassTypeTopBottom
+	if position == "" {
+		position = "Bottom"
+	}
+
+	window := math.Round(((roomArea(room)*200+540)*1.8+
+		30*float64(formationPanes(room.Formation))+
+		glassTypeCosts[glassType]*glassPositionMultipliers[position])*1.28 +
+		float64(room.Encapsulation)*650)
+
+	cost := window * (1 + roomPriceChange(room)/100) * casementFactor(room)
+	if room.Dormer {
+		cost += 420
+	}
+	cost += float64(room.CenterMullion) * 150
+	if room.EasyClean {
+		cost += 80
+	}
+	cost += float64(room.StainRepairs) * 45
+	if room.Shutters {
+		cost += 150
+	}
+	if room.ConcealedVent {
+		cost += 45
+	}
+	if room.TrickleVent {
+		cost += 32
+	}
+	if room.Handles {
+		cost += 22
+	}
+	if room.CustomItem2 > 0 {
+		cost += float64(room.CustomItem2)
+	}
+	return cost
+}
+
+// pvcRoomTotal prices a whole PVC room. Unlike the other options the
+// dormer and easy-clean extras are charged once per room, and the total
+// carries a 30% discount.
+func pvcRoomTotal(room *Room, windows int) float64 {
+	glassType := room.GlassType
+	if glassType == "" {
+		glassType = "Clear"
+	}
+
+	window := math.Round(((roomArea(room)*200+540)*1.8 +
+		30*float64(formationPanes(room.Formation)) +
+		float64(room.Encapsulation)*560 +
+		glassTypeCosts[glassType]) * 1.28)
+
+	cost := window * float64(windows) * casementFactor(room)
+	if room.Dormer {
+		cost += 55
+	}
+	if room.EasyClean {
+		cost += 80
+	}
+	return math.Round(cost * 0.7)
+}
+
+// planningFees returns the admin and planning fees added to an option's
+// quote for the job's planning permission category.
+//
+// PVCPDF looks for the categorised conservation areas under a misspelling
+// ("Concervation Area, Category A") that no job ever has, so PVC quotes for
+// them go out without the £50 admin and £300 planning fees it lists. Until
+// the PDF is fixed, those fees are left out here too.
+func planningFees(option, planningPermission string) (float64, float64) {
+	categorised := planningPermission == PlanningConservationAreaCatA ||
+		planningPermission == PlanningConservationAreaCatB ||
+		planningPermission == PlanningConservationAreaCatC
+
+	switch option {
+	case OptionNewWindows:
+		if categorised {
+			return 0, 200
+		}
+	case OptionPVC:
+		if planningPermission == PlanningConservationArea {
+			return 50, 100
+		}
+	}
+	return 0, 0
+}
+
+// priceJob prices a job as quoted for option. Net is the value excluding
+// VAT and is what margins are measured against.
+func priceJob(job *Job, option string) Quote {
+	quote := Quote{Option: option, Rooms: []RoomPrice{}}
+
+	for i := range job.Rooms {
+		room := &job.Rooms[i]
+		windows := roomWindows(room)
+
+		var perWindow, total float64
+		switch option {
+		case OptionNewWindows:
+			perWindow = newWindowsPerWindow(room)
+			total = math.Round(perWindow * float64(windows))
+		case OptionPVC:
+			total = pvcRoomTotal(room, windows)
+			perWindow = total / float64(windows)
+		default:
+			perWindow = refurbPerWindow(room)
+			total = perWindow * float64(windows)
+		}
+
+		quote.Rooms = append(quote.Rooms, RoomPrice{
+			Ref:       room.Ref,
+			RoomName:  room.RoomName,
+			Windows:   windows,
+			PerWindow: perWindow,
+			Total:     total,
+		})
+		quote.Subtotal += total
+	}
+
+	quote.AdminFee, quote.PlanningFee = planningFees(option, job.PlanningPermission)
+	quote.Net = quote.Subtotal + quote.AdminFee + quote.PlanningFee
+	// PVC quotes do not charge VAT on the planning fee.
+	if option == OptionPVC {
+		quote.VAT = (quote.Subtotal + quote.AdminFee) * vatRate
+	} else {
+		quote.VAT = quote.Net * vatRate
+	}
+	quote.Total = quote.Net + quote.VAT
+	// NewWindowsPDF adds the planning fee to its total a second time, on
+	// top of the subtotal that already includes it, and customers were
+	// quoted that total. Net, which margins are measured against, counts
+	// the fee once.
+	if option == OptionNewWindows {
+		quote.Total += quote.PlanningFee
+	}
+	return quote
+}
+
+// OptionPrice is the net price of a job for one of its options. Jobs keep
+// these up to date so reports can total quoted values in the database.
+type OptionPrice struct {
+	Option string  `json:"option" bson:"option"`
+	Net    float64 `json:"net" bson:"net"`
+}
+
+// jobPrices prices the job for each of its options, in the same order.
+func jobPrices(job *Job) []OptionPrice {
+	options := job.Options
+	if len(options) == 0 {
+		options = []string{OptionRefurb}
+	}
+
+	prices := make([]OptionPrice, 0, len(options))
+	for _, option := range options {
+		prices = append(prices, OptionPrice{
+			Option: option,
+			Net:    math.Round(priceJob(job, option).Net*100) / 100,
+		})
+	}
+	return prices
+}
+
+// quotedOption is the option a job is priced as for costing and reports:
+// its first option, or Refurb when none is set.
+func quotedOption(job *Job) string {
+	if len(job.Options) > 0 {
+		return job.Options[0]
+	}
+	return OptionRefurb
+}
@@ -0,0 +1,356 @@
+// properties.go
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/eoinpatrickreid/preservationWindows-Deployable/address"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A property is a building we have surveyed, independent of who owned it at
+// the time. Planning permission belongs to the building, so it is held here
+// once rather than re-entered on every job.
+
+type Property struct {
+	ID                 primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Key                string             `json:"key" bson:"key"`
+	AddressLineOne     string             `json:"addressLineOne" bson:"addressLineOne"`
+	AddressLineTwo     string             `json:"addressLineTwo" bson:"addressLineTwo"`
+	AddressLineThree   string             `json:"addressLineThree" bson:"addressLineThree"`
+	PostCode           string             `json:"postCode" bson:"postCode"`
+	PlanningPermission string             `json:"planningPermission" bson:"planningPermission"`
+}
+
+// Planning permission values as offered by the client.
+const (
+	PlanningNone                 = "No Planning"
+	PlanningConservationArea     = "Planning Permission: Conservation Area"
+	PlanningConservationAreaCatA = "Planning Permission: Conservation Area, Category A"
+	PlanningConservationAreaCatB = "Planning Permission: Conservation Area, Category B"
+	PlanningConservationAreaCatC = "Planning Permission: Conservation Area, Category C"
+)
+
+func validPlanningPermission(value string) bool {
+	switch value {
+	case "", PlanningNone, PlanningConservationArea,
+		PlanningConservationAreaCatA, PlanningConservationAreaCatB, PlanningConservationAreaCatC:
+		return true
+	}
+	return false
+}
+
+// propertyKey identifies a building by its first address line and postcode,
+// ignoring case, spacing and punctuation. The remaining lines are usually
+// the town or area and vary in how they are written.
+func propertyKey(addressLineOne, postCode string) string {
+	line := address.Key(addressLineOne)
+	postCode = address.CompactPostCode(postCode)
+	if line == "" || postCode == "" {
+		return ""
+	}
+	return line + "|" + postCode
+}
+
+func propertyFromJob(job *Job) Property {
+	return Property{
+		Key:                propertyKey(job.AddressLineOne, job.PostCode),
+		AddressLineOne:     job.AddressLineOne,
+		AddressLineTwo:     job.AddressLineTwo,
+		AddressLineThree:   job.AddressLineThree,
+		PostCode:           job.PostCode,
+		PlanningPermission: job.PlanningPermission,
+	}
+}
+
+// findOrCreateProperty returns the property for the job's address, creating
+// it if needed. The property's planning permission is recorded from the job
+// the first time one is known.
+func findOrCreateProperty(job *Job) (*Property, error) {
+	property := propertyFromJob(job)
+	if property.Key == "" {
+		return nil, nil
+	}
+
+	filter := bson.M{"key": property.Key}
+	update := bson.M{"$setOnInsert": property}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var existing Property
+	err := propertyCollection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&existing)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.PlanningPermission == "" && job.PlanningPermission != "" {
+		_, err := propertyCollection.UpdateOne(context.Background(),
+			bson.M{"_id": existing.ID},
+			bson.M{"$set": bson.M{"planningPermission": job.PlanningPermission}})
+		if err != nil {
+			return nil, err
+		}
+		existing.PlanningPermission = job.PlanningPermission
+	}
+	return &existing, nil
+}
+
+// linkJobProperty sets job.PropertyID from the job's address and fills in
+// the planning permission already held for the property.
+func linkJobProperty(job *Job) error {
+	if !job.PropertyID.IsZero() {
+		return nil
+	}
+
+	property, err := findOrCreateProperty(job)
+	if err != nil || property == nil {
+		return err
+	}
+
+	job.PropertyID = property.ID
+	if job.PlanningPermission == "" {
+		job.PlanningPermission = property.PlanningPermission
+	}
+	return nil
+}
+
+func getProperties(c *fiber.Ctx) error {
+	filter := bson.M{}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+		filter["$or"] = []bson.M{
+			{"addressLineOne": pattern},
+			{"addressLineTwo": pattern},
+			{"addressLineThree": pattern},
+			{"postCode": pattern},
+		}
+	}
+	if planning := c.Query("planningPermission"); planning != "" {
+		filter["planningPermission"] = planning
+	}
+
+	cursor, err := propertyCollection.Find(context.Background(), filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	properties := []Property{}
+	if err := cursor.All(context.Background(), &properties); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding property data",
+		})
+	}
+
+	return c.JSON(properties)
+}
+
+func getProperty(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var property Property
+	err = propertyCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&property)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Property not found",
+		})
+	}
+
+	return c.JSON(property)
+}
+
+func updateProperty(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	property := new(Property)
+	if err := c.BodyParser(property); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	if !validPlanningPermission(property.PlanningPermission) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid planning permission",
+		})
+	}
+
+	if err := normaliseAddressFields(&property.PostCode,
+		&property.AddressLineOne, &property.AddressLineTwo, &property.AddressLineThree); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	property.ID = primitive.NilObjectID
+	property.Key = propertyKey(property.AddressLineOne, property.PostCode)
+	if property.Key == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Address line one and postcode are required",
+		})
+	}
+
+	result, err := propertyCollection.UpdateOne(context.Background(), bson.M{"_id": objID}, bson.M{"$set": property})
+	if mongo.IsDuplicateKeyError(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Another property already has this address",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not update property",
+		})
+	}
+
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Property not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Property updated"})
+}
+
+// findPropertyJobs returns the property's documents from a jobs-shaped
+// collection, oldest first.
+func findPropertyJobs(collection *mongo.Collection, propertyID primitive.ObjectID) ([]Job, error) {
+	cursor, err := collection.Find(context.Background(), notDeleted(bson.M{"propertyId": propertyID}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	jobs := []Job{}
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].Date < jobs[j].Date
+	})
+	return jobs, nil
+}
+
+// getPropertyHistory returns the property with every survey (job) and
+// drawing made for it, including the rooms recorded on each.
+func getPropertyHistory(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var property Property
+	err = propertyCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&property)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Property not found",
+		})
+	}
+
+	jobs, err := findPropertyJobs(jobCollection, objID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	drawings, err := findPropertyJobs(drawingCollection, objID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"property": property,
+		"jobs":     jobs,
+		"drawings": drawings,
+	})
+}
+
+// PropertyMigrationResult summarises a run of linkAllProperties.
+type PropertyMigrationResult struct {
+	Jobs      int `json:"jobs"`
+	Drawings  int `json:"drawings"`
+	Unmatched int `json:"unmatched"`
+}
+
+// linkAllProperties gives every job and drawing without a propertyId the
+// property for its address.
+func linkAllProperties() (PropertyMigrationResult, error) {
+	var result PropertyMigrationResult
+
+	link := func(collection *mongo.Collection, linked *int) error {
+		filter := bson.M{"propertyId": bson.M{"$exists": false}}
+		cursor, err := collection.Find(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(context.Background())
+
+		for cursor.Next(context.Background()) {
+			var job Job
+			if err := cursor.Decode(&job); err != nil {
+				return err
+			}
+
+			property, err := findOrCreateProperty(&job)
+			if err != nil {
+				return err
+			}
+			if property == nil {
+				result.Unmatched++
+				continue
+			}
+
+			_, err = collection.UpdateOne(context.Background(),
+				bson.M{"_id": job.ID},
+				revised(bson.M{"propertyId": property.ID}))
+			if err != nil {
+				return err
+			}
+			*linked++
+		}
+		return cursor.Err()
+	}
+
+	if err := link(jobCollection, &result.Jobs); err != nil {
+		return result, err
+	}
+	if err := link(drawingCollection, &result.Drawings); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func migrateProperties(c *fiber.Ctx) error {
+	result, err := linkAllProperties()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Property migration failed",
+		})
+	}
+
+	return c.JSON(result)
+}
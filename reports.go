@@ -0,0 +1,246 @@
+// reports.go
+
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sales reports are aggregation pipelines over jobs and drawings. Quoted
+// values come from the prices stored on each job; jobs saved before prices
+// were stored need a POST /api/reports/reprice first.
+
+// reportMatch builds the $match stage shared by the reports: jobs not in the
+// trash, optionally limited to quote dates between from and to (inclusive,
+// YYYY-MM-DD or YYYY-MM).
+func reportMatch(c *fiber.Ctx) bson.D {
+	filter := notDeleted(bson.M{})
+	if date := quoteDateRange(c); date != nil {
+		filter["date"] = date
+	}
+	return bson.D{{Key: "$match", Value: filter}}
+}
+
+// quotedValue is the net price of the job's first option.
+var quotedValue = bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$prices.net", 0}}, 0}}
+
+func runReport(c *fiber.Ctx, collection *mongo.Collection, pipeline mongo.Pipeline) error {
+	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	rows := []bson.M{}
+	if err := cursor.All(context.Background(), &rows); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding report data",
+		})
+	}
+
+	return c.JSON(rows)
+}
+
+// getQuotesPerMonth counts the quotes issued each month and their value.
+func getQuotesPerMonth(c *fiber.Ctx) error {
+	pipeline := mongo.Pipeline{
+		reportMatch(c),
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$substrBytes": bson.A{"$date", 0, 7}},
+			"count": bson.M{"$sum": 1},
+			"value": bson.M{"$sum": quotedValue},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":          0,
+			"month":        "$_id",
+			"count":        1,
+			"value":        bson.M{"$round": bson.A{"$value", 2}},
+			"averageValue": bson.M{"$round": bson.A{bson.M{"$divide": bson.A{"$value", "$count"}}, 2}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"month": 1}}},
+	}
+
+	return runReport(c, jobCollection, pipeline)
+}
+
+// getConversionReport reports, per month, how many quotes went on to have
+// a drawing. Drawings keep the quote ID of the job they came from.
+func getConversionReport(c *fiber.Ctx) error {
+	pipeline := mongo.Pipeline{
+		reportMatch(c),
+		{{Key: "$lookup", Value: bson.M{
+			"from":         drawingCollection.Name(),
+			"localField":   "quoteId",
+			"foreignField": "quoteId",
+			"as":           "drawings",
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"converted": bson.M{"$gt": bson.A{
+				bson.M{"$size": bson.M{"$filter": bson.M{
+					"input": "$drawings",
+					"cond":  bson.M{"$not": bson.A{"$$this.deletedAt"}},
+				}}},
+				0,
+			}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            bson.M{"$substrBytes": bson.A{"$date", 0, 7}},
+			"quotes":         bson.M{"$sum": 1},
+			"converted":      bson.M{"$sum": bson.M{"$cond": bson.A{"$converted", 1, 0}}},
+			"quotedValue":    bson.M{"$sum": quotedValue},
+			"convertedValue": bson.M{"$sum": bson.M{"$cond": bson.A{"$converted", quotedValue, 0}}},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":            0,
+			"month":          "$_id",
+			"quotes":         1,
+			"converted":      1,
+			"quotedValue":    bson.M{"$round": bson.A{"$quotedValue", 2}},
+			"convertedValue": bson.M{"$round": bson.A{"$convertedValue", 2}},
+			"conversionRate": bson.M{"$round": bson.A{
+				bson.M{"$multiply": bson.A{bson.M{"$divide": bson.A{"$converted", "$quotes"}}, 100}}, 1,
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"month": 1}}},
+	}
+
+	return runReport(c, jobCollection, pipeline)
+}
+
+// getValueByOption totals the quoted value for each option. A job quoted
+// for several options counts towards each of them.
+func getValueByOption(c *fiber.Ctx) error {
+	pipeline := mongo.Pipeline{
+		reportMatch(c),
+		{{Key: "$unwind", Value: "$prices"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          "$prices.option",
+			"count":        bson.M{"$sum": 1},
+			"value":        bson.M{"$sum": "$prices.net"},
+			"averageValue": bson.M{"$avg": "$prices.net"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":          0,
+			"option":       "$_id",
+			"count":        1,
+			"value":        bson.M{"$round": bson.A{"$value", 2}},
+			"averageValue": bson.M{"$round": bson.A{"$averageValue", 2}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"value": -1}}},
+	}
+
+	return runReport(c, jobCollection, pipeline)
+}
+
+// getValueByPlanning totals the quoted value for each planning permission
+// category.
+func getValueByPlanning(c *fiber.Ctx) error {
+	pipeline := mongo.Pipeline{
+		reportMatch(c),
+		{{Key: "$group", Value: bson.M{
+			"_id":          bson.M{"$ifNull": bson.A{"$planningPermission", ""}},
+			"count":        bson.M{"$sum": 1},
+			"value":        bson.M{"$sum": quotedValue},
+			"averageValue": bson.M{"$avg": quotedValue},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":                0,
+			"planningPermission": "$_id",
+			"count":              1,
+			"value":              bson.M{"$round": bson.A{"$value", 2}},
+			"averageValue":       bson.M{"$round": bson.A{"$averageValue", 2}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"value": -1}}},
+	}
+
+	return runReport(c, jobCollection, pipeline)
+}
+
+// getTopPostCodes ranks postcodes by number of quotes. With
+// district=true postcodes are grouped by their outward code ("G12").
+func getTopPostCodes(c *fiber.Ctx) error {
+	limit, err := strconv.Atoi(c.Query("limit", "10"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Limit must be between 1 and 1000",
+		})
+	}
+
+	var key interface{} = "$postCode"
+	if c.QueryBool("district") {
+		key = bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$postCode", " "}}, 0}}
+	}
+
+	pipeline := mongo.Pipeline{
+		reportMatch(c),
+		{{Key: "$match", Value: bson.M{"postCode": bson.M{"$nin": bson.A{"", nil}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   key,
+			"count": bson.M{"$sum": 1},
+			"value": bson.M{"$sum": quotedValue},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":      0,
+			"postCode": "$_id",
+			"count":    1,
+			"value":    bson.M{"$round": bson.A{"$value", 2}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "value", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+
+	return runReport(c, jobCollection, pipeline)
+}
+
+// repriceAll stores up-to-date prices on every job and drawing.
+func repriceAll() (int, error) {
+	updated := 0
+	for _, collection := range []*mongo.Collection{jobCollection, drawingCollection} {
+		cursor, err := collection.Find(context.Background(), bson.M{})
+		if err != nil {
+			return updated, err
+		}
+
+		for cursor.Next(context.Background()) {
+			var job Job
+			if err := cursor.Decode(&job); err != nil {
+				cursor.Close(context.Background())
+				return updated, err
+			}
+
+			_, err := collection.UpdateOne(context.Background(),
+				bson.M{"_id": job.ID},
+				revised(bson.M{"prices": jobPrices(&job)}))
+			if err != nil {
+				cursor.Close(context.Background())
+				return updated, err
+			}
+			updated++
+		}
+
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+func repriceJobs(c *fiber.Ctx) error {
+	updated, err := repriceAll()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Repricing failed",
+		})
+	}
+
+	return c.JSON(fiber.Map{"updated": updated})
+}
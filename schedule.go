@@ -0,0 +1,441 @@
+// schedule.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A booking puts a fitting team on site for a drawing. Bookings run over
+// whole working days: End is the first working day after the booking.
+
+type Booking struct {
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	DrawingID     primitive.ObjectID `json:"drawingId" bson:"drawingId"`
+	QuoteID       string             `json:"quoteId" bson:"quoteId"`
+	CustomerName  string             `json:"customerName" bson:"customerName"`
+	Team          string             `json:"team" bson:"team"`
+	Start         time.Time          `json:"start" bson:"start"`
+	End           time.Time          `json:"end" bson:"end"`
+	Days          int                `json:"days" bson:"days"`
+	EstimatedDays int                `json:"estimatedDays" bson:"estimatedDays"`
+	Notes         string             `json:"notes" bson:"notes"`
+	CreatedBy     string             `json:"createdBy" bson:"createdBy"`
+}
+
+// BookingRequest is the body accepted when creating or moving a booking.
+// Days may be left out to use the estimate for the drawing.
+type BookingRequest struct {
+	DrawingID string `json:"drawingId"`
+	Team      string `json:"team"`
+	Start     string `json:"start"`
+	Days      int    `json:"days"`
+	Notes     string `json:"notes"`
+}
+
+// estimateFittingDays estimates how many working days a team needs on site
+// to fit a drawing. A drawing quoted for several options is estimated for
+// the slowest of them.
+func estimateFittingDays(model *LabourModel, drawing *Job) int {
+	days := 1
+	for _, estimate := range model.EstimateAll(drawing) {
+		if estimate.SiteDays > days {
+			days = estimate.SiteDays
+		}
+	}
+	return days
+}
+
+func isWorkingDay(t time.Time) bool {
+	return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+}
+
+// addWorkingDays returns the first working day after a run of n working
+// days beginning on start.
+func addWorkingDays(start time.Time, n int) time.Time {
+	t := start
+	for n > 0 {
+		if isWorkingDay(t) {
+			n--
+		}
+		t = t.AddDate(0, 0, 1)
+	}
+	for !isWorkingDay(t) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// A team's bookings are changed under a lock, so that two requests cannot
+// both find the same days free and both book them. The lock is a lease: one
+// held for longer than bookingLockLease belongs to a request that died and
+// is taken over.
+const (
+	bookingLockLease = 30 * time.Second
+	bookingLockWait  = 5 * time.Second
+)
+
+var errTeamBusy = errors.New("team schedule is being changed")
+
+// lockTeam takes the booking lock for team, waiting up to bookingLockWait
+// for another request to release it, and returns the function that
+// releases it.
+func lockTeam(team string) (func(), error) {
+	id := "booking:" + team
+	token := primitive.NewObjectID()
+	deadline := time.Now().Add(bookingLockWait)
+
+	for {
+		now := time.Now()
+		// Matches an expired lock, or upserts a new one if there is none;
+		// a live lock makes the upsert collide with its _id.
+		_, err := lockCollection.UpdateOne(context.Background(),
+			bson.M{"_id": id, "expiresAt": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"token": token, "expiresAt": now.Add(bookingLockLease)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return func() {
+				lockCollection.DeleteOne(context.Background(), bson.M{"_id": id, "token": token})
+			}, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errTeamBusy
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// lockError is the response for a failure to take a team's booking lock.
+func lockError(c *fiber.Ctx, err error) error {
+	if err == errTeamBusy {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "The team's schedule is being changed, try again",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Database error",
+	})
+}
+
+// findClashes returns the team's bookings overlapping [start, end), other
+// than the booking being moved.
+func findClashes(team string, start, end time.Time, exclude primitive.ObjectID) ([]Booking, error) {
+	filter := bson.M{
+		"team":  team,
+		"start": bson.M{"$lt": end},
+		"end":   bson.M{"$gt": start},
+	}
+	if !exclude.IsZero() {
+		filter["_id"] = bson.M{"$ne": exclude}
+	}
+
+	cursor, err := scheduleCollection.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	clashes := []Booking{}
+	if err := cursor.All(context.Background(), &clashes); err != nil {
+		return nil, err
+	}
+	return clashes, nil
+}
+
+// bookingFromRequest validates a booking request and builds the booking it
+// describes, looking up the drawing for the estimate. Validation failures
+// are returned as a *fiber.Error carrying the response status.
+func bookingFromRequest(req *BookingRequest) (*Booking, *fiber.Error) {
+	if req.Team == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Team is required")
+	}
+
+	drawingID, err := primitive.ObjectIDFromHex(req.DrawingID)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid drawing ID")
+	}
+
+	start, err := time.Parse("2006-01-02", req.Start)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Start must be a date (YYYY-MM-DD)")
+	}
+	if !isWorkingDay(start) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Start must be a working day")
+	}
+
+	if req.Days < 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Days cannot be negative")
+	}
+
+	var drawing Job
+	err = drawingCollection.FindOne(context.Background(), notDeleted(bson.M{"_id": drawingID})).Decode(&drawing)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Drawing not found")
+	}
+
+	model, err := loadLabourModel()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Could not load labour model")
+	}
+
+	booking := &Booking{
+		DrawingID:     drawingID,
+		QuoteID:       drawing.QuoteID,
+		CustomerName:  drawing.CustomerName,
+		Team:          req.Team,
+		Start:         start,
+		Days:          req.Days,
+		EstimatedDays: estimateFittingDays(model, &drawing),
+		Notes:         req.Notes,
+	}
+	if booking.Days == 0 {
+		booking.Days = booking.EstimatedDays
+	}
+	booking.End = addWorkingDays(booking.Start, booking.Days)
+
+	return booking, nil
+}
+
+// getSchedule lists bookings overlapping the from/to range, for the
+// calendar view. Either bound may be omitted.
+func getSchedule(c *fiber.Ctx) error {
+	filter := bson.M{}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from date",
+			})
+		}
+		filter["end"] = bson.M{"$gt": t}
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to date",
+			})
+		}
+		filter["start"] = bson.M{"$lte": t}
+	}
+	if team := c.Query("team"); team != "" {
+		filter["team"] = team
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "start", Value: 1}, {Key: "team", Value: 1}})
+	cursor, err := scheduleCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	bookings := []Booking{}
+	if err := cursor.All(context.Background(), &bookings); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding schedule data",
+		})
+	}
+
+	return c.JSON(bookings)
+}
+
+func getBooking(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var booking Booking
+	err = scheduleCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&booking)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Booking not found",
+		})
+	}
+
+	return c.JSON(booking)
+}
+
+func getFittingEstimate(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("drawingId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid drawing ID",
+		})
+	}
+
+	var drawing Job
+	err = drawingCollection.FindOne(context.Background(), notDeleted(bson.M{"_id": objID})).Decode(&drawing)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Drawing not found",
+		})
+	}
+
+	model, err := loadLabourModel()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not load labour model",
+		})
+	}
+
+	return c.JSON(fiber.Map{"estimatedDays": estimateFittingDays(model, &drawing)})
+}
+
+func createBooking(c *fiber.Ctx) error {
+	var req BookingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	booking, ferr := bookingFromRequest(&req)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+	booking.CreatedBy = currentUserEmail(c)
+
+	unlock, err := lockTeam(booking.Team)
+	if err != nil {
+		return lockError(c, err)
+	}
+	defer unlock()
+
+	clashes, err := findClashes(booking.Team, booking.Start, booking.End, primitive.NilObjectID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if len(clashes) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "Team is already booked",
+			"clashes": clashes,
+		})
+	}
+
+	result, err := scheduleCollection.InsertOne(context.Background(), booking)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create booking",
+		})
+	}
+
+	booking.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(booking)
+}
+
+func updateBooking(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var req BookingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON",
+		})
+	}
+
+	booking, ferr := bookingFromRequest(&req)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	// Only the team being booked needs the lock; a team a booking moves
+	// away from can only gain free days.
+	unlock, err := lockTeam(booking.Team)
+	if err != nil {
+		return lockError(c, err)
+	}
+	defer unlock()
+
+	clashes, err := findClashes(booking.Team, booking.Start, booking.End, objID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if len(clashes) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "Team is already booked",
+			"clashes": clashes,
+		})
+	}
+
+	update := bson.M{"$set": bson.M{
+		"drawingId":     booking.DrawingID,
+		"quoteId":       booking.QuoteID,
+		"customerName":  booking.CustomerName,
+		"team":          booking.Team,
+		"start":         booking.Start,
+		"end":           booking.End,
+		"days":          booking.Days,
+		"estimatedDays": booking.EstimatedDays,
+		"notes":         booking.Notes,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated Booking
+	err = scheduleCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": objID}, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Booking not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not update booking",
+		})
+	}
+
+	return c.JSON(updated)
+}
+
+func deleteBooking(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	result, err := scheduleCollection.DeleteOne(context.Background(), bson.M{"_id": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not delete booking",
+		})
+	}
+
+	if result.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Booking not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Booking deleted"})
+}
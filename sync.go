@@ -0,0 +1,320 @@
+// sync.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Offline sync for the survey client. Every job and drawing carries a rev,
+// bumped on each write, and an updatedAt timestamp. Clients pull changes
+// with GET /api/sync?since=<until from the last pull> and push the edits
+// they queued while offline with POST /api/sync. An edit is only applied
+// if the document is still at the rev the client last saw; otherwise it is
+// reported back as a conflict along with the server's copy. An update need
+// only carry the fields it changes.
+
+// syncOverlap is how far before the pull the returned until is set, so a
+// write that was in flight during the pull is picked up by the next one.
+// Documents in the overlap are sent twice; clients keep the higher rev.
+const syncOverlap = 5 * time.Second
+
+// revised turns a $set into an update that also bumps the revision, for
+// writes to jobs and drawings outside the usual handlers.
+func revised(set bson.M) bson.M {
+	set["updatedAt"] = time.Now()
+	return bson.M{"$set": set, "$inc": bson.M{"rev": 1}}
+}
+
+// Tombstone marks a job or drawing deleted since the last pull.
+type Tombstone struct {
+	Type      string             `json:"type"`
+	ID        primitive.ObjectID `json:"id"`
+	Rev       int                `json:"rev"`
+	DeletedAt time.Time          `json:"deletedAt"`
+}
+
+// SyncFeed is the response to GET /api/sync. When FullResync is set the
+// client's copy is too old to bring up to date with tombstones alone, and
+// it should replace everything it holds with Jobs and Drawings.
+type SyncFeed struct {
+	Until      time.Time   `json:"until"`
+	FullResync bool        `json:"fullResync"`
+	Jobs       []Job       `json:"jobs"`
+	Drawings   []Job       `json:"drawings"`
+	Deleted    []Tombstone `json:"deleted"`
+}
+
+// changedSince returns the documents written at or after since, split into
+// live documents and tombstones. A zero since returns every live document.
+func changedSince(collection *mongo.Collection, targetType string, since time.Time) ([]Job, []Tombstone, error) {
+	filter := notDeleted(bson.M{})
+	if !since.IsZero() {
+		filter = bson.M{"updatedAt": bson.M{"$gte": since}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	live := []Job{}
+	deleted := []Tombstone{}
+	for cursor.Next(context.Background()) {
+		var job Job
+		if err := cursor.Decode(&job); err != nil {
+			return nil, nil, err
+		}
+		if job.DeletedAt != nil {
+			deleted = append(deleted, Tombstone{targetType, job.ID, job.Rev, *job.DeletedAt})
+			continue
+		}
+		live = append(live, job)
+	}
+	return live, deleted, cursor.Err()
+}
+
+func getSync(c *fiber.Ctx) error {
+	var since time.Time
+	if value := c.Query("since"); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid since timestamp",
+			})
+		}
+		since = t
+	}
+
+	now := time.Now()
+	feed := SyncFeed{Until: now.Add(-syncOverlap)}
+
+	// Tombstones go when the trash is purged, so a client that last pulled
+	// before then may have missed deletes and must start again.
+	if since.IsZero() || (trashRetention > 0 && since.Before(now.Add(-trashRetention))) {
+		feed.FullResync = true
+		since = time.Time{}
+	}
+
+	var jobsDeleted, drawingsDeleted []Tombstone
+	var err error
+	if feed.Jobs, jobsDeleted, err = changedSince(jobCollection, "job", since); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if feed.Drawings, drawingsDeleted, err = changedSince(drawingCollection, "drawing", since); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	feed.Deleted = append(jobsDeleted, drawingsDeleted...)
+
+	return c.JSON(feed)
+}
+
+// SyncChange is one queued offline edit. ID is generated by the client for
+// creates, and BaseRev is the rev the client edited for updates and deletes.
+type SyncChange struct {
+	Type    string          `json:"type"`
+	Op      string          `json:"op"`
+	ID      string          `json:"id"`
+	BaseRev int             `json:"baseRev"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// SyncResult reports what happened to one change. Status is "applied",
+// "conflict" or "error". Doc is the server's copy after an applied change,
+// or the copy that won a conflict, which may be in the trash.
+type SyncResult struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Doc    *Job   `json:"doc,omitempty"`
+}
+
+// postSync applies a batch of offline changes in order. Each change stands
+// alone: a conflict or error in one does not stop the rest.
+func postSync(c *fiber.Ctx) error {
+	var body struct {
+		Changes []SyncChange `json:"changes"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Each applied change is audited on its own, and a push where nothing
+	// applied changed nothing.
+	c.Locals(auditedKey, true)
+
+	results := make([]SyncResult, 0, len(body.Changes))
+	for _, change := range body.Changes {
+		result := applySyncChange(c, change)
+		result.Type = change.Type
+		result.ID = change.ID
+		results = append(results, result)
+	}
+
+	return c.JSON(fiber.Map{"results": results})
+}
+
+// mergeSyncUpdate applies the fields present in an update's data to the
+// stored document. The whole document is written back, so fields a client
+// leaves out, because it only sends what changed or predates them, keep
+// their stored values instead of being cleared. Arrays present in the data
+// replace the stored ones whole.
+func mergeSyncUpdate(current *Job, data json.RawMessage) (Job, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Job{}, err
+	}
+
+	job := *current
+	// Decoding into a slice reuses its elements, which would let stored
+	// room fields leak into rooms the data leaves them out of.
+	if _, ok := fields["rooms"]; ok {
+		job.Rooms = nil
+	} else {
+		job.Rooms = append([]Room(nil), current.Rooms...)
+	}
+	if _, ok := fields["options"]; ok {
+		job.Options = nil
+	}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+func syncError(message string) SyncResult {
+	return SyncResult{Status: "error", Error: message}
+}
+
+func applySyncChange(c *fiber.Ctx, change SyncChange) SyncResult {
+	if change.Type != "job" && change.Type != "drawing" {
+		return syncError("Unknown type")
+	}
+	collection := targetCollection(change.Type)
+	objID, err := primitive.ObjectIDFromHex(change.ID)
+	if err != nil {
+		return syncError("Invalid ID")
+	}
+
+	var current Job
+	err = collection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&current)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return syncError("Database error")
+	}
+	exists := err == nil
+	before := auditSnapshot(collection, change.ID)
+
+	switch change.Op {
+	case "create":
+		if change.Type != "job" {
+			return syncError("Drawings are created by converting a job")
+		}
+		// A create that is already there is a retry whose response was lost.
+		if exists {
+			return SyncResult{Status: "applied", Doc: &current}
+		}
+
+		var job Job
+		if err := json.Unmarshal(change.Data, &job); err != nil {
+			return syncError(err.Error())
+		}
+		if job.Surveyor == "" {
+			job.Surveyor = currentUserEmail(c)
+		}
+		if ferr := prepareJob(&job); ferr != nil {
+			return syncError(ferr.Message)
+		}
+		job.ID = objID
+		if ferr := insertJob(&job); ferr != nil {
+			return syncError(ferr.Message)
+		}
+		recordAudit(c, fiber.StatusCreated, collection, change.ID, nil)
+		return SyncResult{Status: "applied", Doc: &job}
+
+	case "update":
+		if !exists {
+			return syncError("Not found")
+		}
+		if current.DeletedAt != nil || current.Rev != change.BaseRev {
+			return SyncResult{Status: "conflict", Doc: &current}
+		}
+
+		job, err := mergeSyncUpdate(&current, change.Data)
+		if err != nil {
+			return syncError(err.Error())
+		}
+		job.ID = primitive.NilObjectID
+		update, ferr := prepareJobUpdate(&job, current.Rooms)
+		if ferr != nil {
+			return syncError(ferr.Message)
+		}
+
+		filter := notDeleted(bson.M{"_id": objID, "rev": change.BaseRev})
+		result, err := collection.UpdateOne(context.Background(), filter, update)
+		if err != nil {
+			return syncError("Database error")
+		}
+		if result.MatchedCount > 0 {
+			// The update has been applied, so a failure here must not be
+			// reported as the change failing.
+			if err := reattachPhotos(change.Type, objID, job.Rooms); err != nil {
+				log.Println("Sync photo update error:", err)
+			}
+		}
+		return syncOutcome(c, collection, objID, before, result.MatchedCount > 0)
+
+	case "delete":
+		if !exists {
+			return syncError("Not found")
+		}
+		// Deleting something already in the trash has the effect asked for.
+		if current.DeletedAt != nil {
+			return SyncResult{Status: "applied", Doc: &current}
+		}
+		if current.Rev != change.BaseRev {
+			return SyncResult{Status: "conflict", Doc: &current}
+		}
+
+		filter := bson.M{"_id": objID, "rev": change.BaseRev}
+		result, err := softDeleteWhere(collection, filter, currentUserEmail(c))
+		if err != nil {
+			return syncError("Database error")
+		}
+		return syncOutcome(c, collection, objID, before, result.MatchedCount > 0)
+	}
+
+	return syncError("Unknown op")
+}
+
+// syncOutcome reloads a document after a conditional write. If the write
+// matched nothing, someone else changed the document after it was checked,
+// and the change is a conflict after all.
+func syncOutcome(c *fiber.Ctx, collection *mongo.Collection, objID primitive.ObjectID, before bson.M, matched bool) SyncResult {
+	var doc Job
+	if err := collection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&doc); err != nil {
+		return syncError("Database error")
+	}
+	if !matched {
+		return SyncResult{Status: "conflict", Doc: &doc}
+	}
+	recordAudit(c, fiber.StatusOK, collection, objID.Hex(), before)
+	return SyncResult{Status: "applied", Doc: &doc}
+}
@@ -0,0 +1,209 @@
+// trash.go
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Soft delete helpers: jobs and drawings are never removed straight away.
+// Deleting sets deletedAt/deletedBy, which hides the document from the
+// normal queries until it is restored or purged.
+
+// notDeleted adds the "not in the trash" condition to a filter. A nil
+// comparison matches both a missing field and an explicit null.
+func notDeleted(filter bson.M) bson.M {
+	filter["deletedAt"] = nil
+	return filter
+}
+
+func inTrash(filter bson.M) bson.M {
+	filter["deletedAt"] = bson.M{"$ne": nil}
+	return filter
+}
+
+func softDelete(collection *mongo.Collection, objID primitive.ObjectID, deletedBy string) (*mongo.UpdateResult, error) {
+	return softDeleteWhere(collection, bson.M{"_id": objID}, deletedBy)
+}
+
+// softDeleteWhere moves the document matching filter to the trash, and
+// bumps its revision so sync clients see it as deleted.
+func softDeleteWhere(collection *mongo.Collection, filter bson.M, deletedBy string) (*mongo.UpdateResult, error) {
+	filter = notDeleted(filter)
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"deletedAt": now,
+			"deletedBy": deletedBy,
+			"updatedAt": now,
+		},
+		"$inc": bson.M{"rev": 1},
+	}
+	return collection.UpdateOne(context.Background(), filter, update)
+}
+
+func restore(collection *mongo.Collection, objID primitive.ObjectID) (*mongo.UpdateResult, error) {
+	filter := inTrash(bson.M{"_id": objID})
+	update := bson.M{
+		"$unset": bson.M{
+			"deletedAt": "",
+			"deletedBy": "",
+		},
+		"$set": bson.M{"updatedAt": time.Now()},
+		"$inc": bson.M{"rev": 1},
+	}
+	return collection.UpdateOne(context.Background(), filter, update)
+}
+
+func findTrashed(collection *mongo.Collection) ([]Job, error) {
+	cursor, err := collection.Find(context.Background(), inTrash(bson.M{}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	items := []Job{}
+	if err := cursor.All(context.Background(), &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func getTrashedJobs(c *fiber.Ctx) error {
+	jobs, err := findTrashed(jobCollection)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.JSON(jobs)
+}
+
+func getTrashedDrawings(c *fiber.Ctx) error {
+	drawings, err := findTrashed(drawingCollection)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.JSON(drawings)
+}
+
+func restoreJob(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	result, err := restore(jobCollection, objID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not restore job",
+		})
+	}
+
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found in trash",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Job restored"})
+}
+
+func restoreDrawing(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	result, err := restore(drawingCollection, objID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not restore drawing",
+		})
+	}
+
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Drawing not found in trash",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Drawing restored"})
+}
+
+// purgeTrash permanently removes jobs and drawings that have been in the
+// trash for longer than retention.
+func purgeTrash(retention time.Duration) (int64, error) {
+	filter := bson.M{"deletedAt": bson.M{"$lt": time.Now().Add(-retention)}}
+
+	var purged int64
+	targets := []struct {
+		collection *mongo.Collection
+		targetType string
+	}{
+		{jobCollection, "job"},
+		{drawingCollection, "drawing"},
+	}
+	for _, target := range targets {
+		ids, err := target.collection.Distinct(context.Background(), "_id", filter)
+		if err != nil {
+			return purged, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		objIDs := make([]primitive.ObjectID, 0, len(ids))
+		for _, id := range ids {
+			if objID, ok := id.(primitive.ObjectID); ok {
+				objIDs = append(objIDs, objID)
+			}
+		}
+		if err := deletePhotosOf(target.targetType, objIDs); err != nil {
+			return purged, err
+		}
+
+		result, err := target.collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return purged, err
+		}
+		purged += result.DeletedCount
+	}
+	return purged, nil
+}
+
+// purgeTrashPeriodically runs purgeTrash once an hour. A retention of zero
+// or less keeps trashed documents forever.
+func purgeTrashPeriodically(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		purged, err := purgeTrash(retention)
+		if err != nil {
+			log.Println("Trash purge error:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d documents from trash\n", purged)
+		}
+		<-ticker.C
+	}
+}
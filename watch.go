@@ -0,0 +1,270 @@
+// watch.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The watcher turns writes to jobs and drawings into events. It follows a
+// MongoDB change stream where the server has one (replica sets), and
+// otherwise polls for documents whose updatedAt has moved on. Either way
+// each changed document is compared with a snapshot of the last version
+// seen, which is how room events are worked out and how documents seen
+// twice by overlapping polls are skipped.
+
+// watchRetry is how long to wait before reopening a change stream that
+// failed part way.
+const watchRetry = 5 * time.Second
+
+// watchPollInterval is how often to poll when change streams are
+// unavailable; WATCH_POLL_SECONDS overrides it.
+var watchPollInterval = 3 * time.Second
+
+// docSnapshot is what the watcher remembers of a job or drawing.
+type docSnapshot struct {
+	rev       int
+	deleted   bool
+	completed bool
+	rooms     []uint64
+}
+
+type watcher struct {
+	seen    map[string]docSnapshot // by viewTarget
+	started time.Time
+}
+
+// watchedTypes maps the watched collections to their target types.
+func watchedTypes() map[string]string {
+	return map[string]string{
+		jobCollection.Name():     "job",
+		drawingCollection.Name(): "drawing",
+	}
+}
+
+func roomFingerprints(rooms []Room) []uint64 {
+	prints := make([]uint64, len(rooms))
+	for i, room := range rooms {
+		data, _ := json.Marshal(room)
+		h := fnv.New64a()
+		h.Write(data)
+		prints[i] = h.Sum64()
+	}
+	return prints
+}
+
+func snapshotOf(job *Job) docSnapshot {
+	return docSnapshot{
+		rev:       job.Rev,
+		deleted:   job.DeletedAt != nil,
+		completed: job.Completed,
+		rooms:     roomFingerprints(job.Rooms),
+	}
+}
+
+// load snapshots every job and drawing, so that the first change to each
+// after startup can be compared with something.
+func (w *watcher) load() error {
+	for name, targetType := range watchedTypes() {
+		cursor, err := database.Collection(name).Find(context.Background(), bson.M{})
+		if err != nil {
+			return err
+		}
+		for cursor.Next(context.Background()) {
+			var job Job
+			if err := cursor.Decode(&job); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+			w.seen[viewTarget(targetType, job.ID.Hex())] = snapshotOf(&job)
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observe publishes the events for a job or drawing as it is now.
+func (w *watcher) observe(targetType string, job *Job) {
+	key := viewTarget(targetType, job.ID.Hex())
+	old, known := w.seen[key]
+	if known && job.Rev != 0 && job.Rev <= old.rev {
+		return
+	}
+	now := snapshotOf(job)
+	w.seen[key] = now
+
+	op := "updated"
+	switch {
+	case !known && now.deleted:
+		op = "deleted"
+	case !known:
+		op = "created"
+	case now.deleted && !old.deleted:
+		op = "deleted"
+	case !now.deleted && old.deleted:
+		op = "restored"
+	}
+	e := Event{Name: targetType + "." + op, Type: targetType, ID: job.ID.Hex(), Rev: job.Rev}
+	events.publish(e)
+	queueWebhooks(e.Name, job)
+	if targetType == "job" && now.completed && !old.completed && !now.deleted {
+		queueWebhooks("job.completed", job)
+	}
+
+	if op == "updated" {
+		for i := 0; i < len(now.rooms) || i < len(old.rooms); i++ {
+			room := i
+			e := Event{Type: targetType, ID: job.ID.Hex(), Rev: job.Rev, Room: &room}
+			switch {
+			case i >= len(old.rooms):
+				e.Name = "room.created"
+			case i >= len(now.rooms):
+				e.Name = "room.deleted"
+			case now.rooms[i] != old.rooms[i]:
+				e.Name = "room.updated"
+			default:
+				continue
+			}
+			events.publish(e)
+		}
+	}
+}
+
+// removed handles a document deleted outright, as purging the trash does.
+func (w *watcher) removed(targetType string, id primitive.ObjectID) {
+	key := viewTarget(targetType, id.Hex())
+	old, known := w.seen[key]
+	delete(w.seen, key)
+	if known && !old.deleted {
+		events.publish(Event{Name: targetType + ".deleted", Type: targetType, ID: id.Hex()})
+	}
+}
+
+// changeEvent is the part of a change stream event the watcher reads.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	Namespace     struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *Job `bson:"fullDocument"`
+}
+
+var errChangeStreamsUnavailable = errors.New("change streams unavailable")
+
+// follow reads the change stream until it fails, starting after resume if
+// it is set. It returns the last resume token seen.
+func (w *watcher) follow(resume bson.Raw) (bson.Raw, error) {
+	types := watchedTypes()
+	names := make(bson.A, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"ns.coll": bson.M{"$in": names}}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resume != nil {
+		opts.SetResumeAfter(resume)
+	}
+
+	stream, err := database.Watch(context.Background(), pipeline, opts)
+	if err != nil {
+		var serverErr mongo.ServerError
+		// 40573: the $changeStream stage needs a replica set
+		if errors.As(err, &serverErr) && serverErr.HasErrorCode(40573) {
+			return resume, errChangeStreamsUnavailable
+		}
+		// 286: the oplog no longer reaches back to resume, so start afresh
+		if errors.As(err, &serverErr) && serverErr.HasErrorCode(286) {
+			return nil, err
+		}
+		return resume, err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(context.Background()) {
+		var change changeEvent
+		if err := stream.Decode(&change); err != nil {
+			return resume, err
+		}
+		resume = stream.ResumeToken()
+
+		targetType := types[change.Namespace.Coll]
+		switch change.OperationType {
+		case "insert", "update", "replace":
+			if change.FullDocument != nil {
+				w.observe(targetType, change.FullDocument)
+			}
+		case "delete":
+			w.removed(targetType, change.DocumentKey.ID)
+		}
+	}
+	return resume, stream.Err()
+}
+
+// poll checks for changed documents every interval, forever. It cannot see
+// documents deleted outright, but those are only ever purged from the
+// trash, and moving them there was already an update.
+func (w *watcher) poll(interval time.Duration) {
+	since := w.started
+	for range time.Tick(interval) {
+		from := since.Add(-syncOverlap)
+		since = time.Now()
+
+		for name, targetType := range watchedTypes() {
+			filter := bson.M{"updatedAt": bson.M{"$gte": from}}
+			cursor, err := database.Collection(name).Find(context.Background(), filter)
+			if err != nil {
+				log.Println("Watch poll error:", err)
+				continue
+			}
+			for cursor.Next(context.Background()) {
+				var job Job
+				if err := cursor.Decode(&job); err != nil {
+					log.Println("Watch poll error:", err)
+					break
+				}
+				w.observe(targetType, &job)
+			}
+			cursor.Close(context.Background())
+		}
+	}
+}
+
+// watchChanges runs the watcher for as long as the server runs.
+func watchChanges() {
+	w := &watcher{seen: map[string]docSnapshot{}, started: time.Now()}
+	if err := w.load(); err != nil {
+		log.Println("Watch error:", err)
+	}
+
+	var resume bson.Raw
+	for {
+		var err error
+		resume, err = w.follow(resume)
+		if err == errChangeStreamsUnavailable {
+			log.Printf("Change streams unavailable, polling every %s\n", watchPollInterval)
+			w.poll(watchPollInterval)
+			return
+		}
+		log.Println("Change stream error:", err)
+		time.Sleep(watchRetry)
+	}
+}
@@ -0,0 +1,623 @@
+// webhooks.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outbound webhooks. The watcher queues a delivery for every subscribed
+// webhook when a job or drawing changes, and a background worker POSTs
+// them. Each request is signed: X-Webhook-Signature is "sha256=" and the
+// hex HMAC-SHA256, keyed with the webhook's secret, of the
+// X-Webhook-Timestamp header, a ".", and the body. Failed deliveries are
+// retried with exponential backoff and every attempt is kept in the log.
+
+var webhookEvents = []string{
+	"job.created",
+	"job.updated",
+	"job.completed",
+	"job.deleted",
+	"job.restored",
+	"drawing.created",
+	"drawing.updated",
+	"drawing.deleted",
+	"drawing.restored",
+}
+
+// Delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 8
+	webhookFirstRetry  = 30 * time.Second
+	webhookMaxRetry    = 6 * time.Hour
+	// A claimed delivery that has not been finished after this long, e.g.
+	// because the server stopped mid-request, is tried again.
+	webhookLease        = time.Minute
+	webhookPollInterval = 5 * time.Second
+)
+
+type Webhook struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	URL       string             `json:"url" bson:"url"`
+	Secret    string             `json:"secret,omitempty" bson:"secret"`
+	Events    []string           `json:"events" bson:"events"`
+	Active    bool               `json:"active" bson:"active"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	CreatedBy string             `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+}
+
+// DeliveryAttempt is one try at sending a delivery.
+type DeliveryAttempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMs int64     `json:"durationMs" bson:"durationMs"`
+}
+
+// WebhookDelivery is one event for one webhook. Deliveries queued by the
+// watcher have IDs made from the webhook, event, document and rev, so
+// several servers seeing the same change queue it only once.
+type WebhookDelivery struct {
+	ID            string             `json:"_id" bson:"_id"`
+	WebhookID     primitive.ObjectID `json:"webhookId" bson:"webhookId"`
+	Event         string             `json:"event" bson:"event"`
+	Payload       json.RawMessage    `json:"payload" bson:"payload"`
+	Status        string             `json:"status" bson:"status"`
+	Attempts      []DeliveryAttempt  `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	DeliveredAt   *time.Time         `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+	ReplayOf      string             `json:"replayOf,omitempty" bson:"replayOf,omitempty"`
+}
+
+// webhookSignature signs body as sent at timestamp.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// webhookRetryDelay is how long to wait after the given number of failed
+// attempts.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookFirstRetry
+	for i := 1; i < attempts && delay < webhookMaxRetry; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetry {
+		delay = webhookMaxRetry
+	}
+	return delay
+}
+
+func webhookPayload(id, event string, data interface{}) (json.RawMessage, error) {
+	return json.Marshal(fiber.Map{
+		"id":        id,
+		"event":     event,
+		"createdAt": time.Now(),
+		"data":      data,
+	})
+}
+
+// queueWebhooks queues event, about the given revision of a job or
+// drawing, for every active webhook subscribed to it.
+func queueWebhooks(event string, job *Job) {
+	cursor, err := webhookCollection.Find(context.Background(), bson.M{"active": true, "events": event})
+	if err != nil {
+		log.Println("Webhook queue error:", err)
+		return
+	}
+	var hooks []Webhook
+	if err := cursor.All(context.Background(), &hooks); err != nil {
+		log.Println("Webhook queue error:", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		id := fmt.Sprintf("%s:%s:%s:%d", hook.ID.Hex(), event, job.ID.Hex(), job.Rev)
+		payload, err := webhookPayload(id, event, job)
+		if err != nil {
+			log.Println("Webhook queue error:", err)
+			return
+		}
+		delivery := WebhookDelivery{
+			ID:            id,
+			WebhookID:     hook.ID,
+			Event:         event,
+			Payload:       payload,
+			Status:        DeliveryPending,
+			Attempts:      []DeliveryAttempt{},
+			NextAttemptAt: time.Now(),
+			CreatedAt:     time.Now(),
+		}
+		_, err = webhookDeliveryCollection.InsertOne(context.Background(), delivery)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			log.Println("Webhook queue error:", err)
+		}
+	}
+}
+
+// claimDelivery takes the next due delivery, leasing it so that no other
+// worker picks it up while it is being sent.
+func claimDelivery() (*WebhookDelivery, error) {
+	now := time.Now()
+	filter := bson.M{"status": DeliveryPending, "nextAttemptAt": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"nextAttemptAt": now.Add(webhookLease)}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"nextAttemptAt": 1}).
+		SetReturnDocument(options.After)
+
+	var delivery WebhookDelivery
+	err := webhookDeliveryCollection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// sendDelivery makes one attempt at delivery and records the outcome.
+func sendDelivery(delivery *WebhookDelivery) error {
+	var hook Webhook
+	err := webhookCollection.FindOne(context.Background(), bson.M{"_id": delivery.WebhookID}).Decode(&hook)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	attempt := DeliveryAttempt{At: time.Now()}
+	switch {
+	case err == mongo.ErrNoDocuments:
+		attempt.Error = "webhook has been deleted"
+	case !hook.Active:
+		attempt.Error = "webhook is disabled"
+	default:
+		timestamp := strconv.FormatInt(attempt.At.Unix(), 10)
+		req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+		if err != nil {
+			attempt.Error = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "preservationWindows-webhooks")
+		req.Header.Set("X-Webhook-Event", delivery.Event)
+		req.Header.Set("X-Webhook-Delivery", delivery.ID)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", webhookSignature(hook.Secret, timestamp, delivery.Payload))
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			attempt.Error = err.Error()
+			break
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		attempt.StatusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			attempt.Error = resp.Status
+		}
+	}
+	attempt.DurationMs = time.Since(attempt.At).Milliseconds()
+
+	set := bson.M{}
+	switch {
+	case attempt.Error == "":
+		set["status"] = DeliveryDelivered
+		set["deliveredAt"] = time.Now()
+	case len(delivery.Attempts)+1 >= webhookMaxAttempts || hook.ID.IsZero() || !hook.Active:
+		set["status"] = DeliveryFailed
+	default:
+		set["nextAttemptAt"] = time.Now().Add(webhookRetryDelay(len(delivery.Attempts) + 1))
+	}
+	_, err = webhookDeliveryCollection.UpdateOne(context.Background(),
+		bson.M{"_id": delivery.ID},
+		bson.M{"$set": set, "$push": bson.M{"attempts": attempt}})
+	return err
+}
+
+// deliverWebhooksPeriodically sends due deliveries for as long as the
+// server runs.
+func deliverWebhooksPeriodically() {
+	for range time.Tick(webhookPollInterval) {
+		for {
+			delivery, err := claimDelivery()
+			if err != nil {
+				log.Println("Webhook delivery error:", err)
+				break
+			}
+			if delivery == nil {
+				break
+			}
+			if err := sendDelivery(delivery); err != nil {
+				log.Println("Webhook delivery error:", err)
+			}
+		}
+	}
+}
+
+// validateWebhook checks the URL and events of a webhook.
+func validateWebhook(hook *Webhook) *fiber.Error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "URL must be an http or https URL")
+	}
+	if len(hook.Events) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "At least one event is required")
+	}
+	for _, event := range hook.Events {
+		known := false
+		for _, e := range webhookEvents {
+			if e == event {
+				known = true
+			}
+		}
+		if !known {
+			return fiber.NewError(fiber.StatusBadRequest, "Unknown event "+event)
+		}
+	}
+	return nil
+}
+
+func getWebhooks(c *fiber.Ctx) error {
+	cursor, err := webhookCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	hooks := []Webhook{}
+	if err := cursor.All(context.Background(), &hooks); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding webhook data",
+		})
+	}
+	// Secrets are only shown when a webhook is created or its secret changed
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return c.JSON(hooks)
+}
+
+// createWebhook adds a subscription. A secret is generated if none is
+// given, and returned in the response; it is not shown again.
+func createWebhook(c *fiber.Ctx) error {
+	var body struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	hook := Webhook{
+		URL:       body.URL,
+		Secret:    body.Secret,
+		Events:    body.Events,
+		Active:    body.Active == nil || *body.Active,
+		CreatedAt: time.Now(),
+		CreatedBy: currentUserEmail(c),
+	}
+	if ferr := validateWebhook(&hook); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+	if hook.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate secret",
+			})
+		}
+		hook.Secret = secret
+	}
+
+	result, err := webhookCollection.InsertOne(context.Background(), hook)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create webhook",
+		})
+	}
+	hook.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.Status(fiber.StatusCreated).JSON(hook)
+}
+
+// updateWebhook changes whichever of url, secret, events and active are
+// given. Setting secret to "generate" makes a new one.
+func updateWebhook(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	var body struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var hook Webhook
+	err = webhookCollection.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&hook)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if body.URL != nil {
+		hook.URL = *body.URL
+	}
+	if body.Events != nil {
+		hook.Events = body.Events
+	}
+	if body.Active != nil {
+		hook.Active = *body.Active
+	}
+	if ferr := validateWebhook(&hook); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	secretChanged := body.Secret != nil && *body.Secret != ""
+	if secretChanged {
+		hook.Secret = *body.Secret
+		if hook.Secret == "generate" {
+			if hook.Secret, err = newWebhookSecret(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to generate secret",
+				})
+			}
+		}
+	}
+
+	_, err = webhookCollection.ReplaceOne(context.Background(), bson.M{"_id": objID}, hook)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update webhook",
+		})
+	}
+
+	if !secretChanged {
+		hook.Secret = ""
+	}
+	return c.JSON(hook)
+}
+
+func deleteWebhook(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	result, err := webhookCollection.DeleteOne(context.Background(), bson.M{"_id": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not delete webhook",
+		})
+	}
+	if result.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Webhook deleted"})
+}
+
+// pingWebhook queues a "ping" delivery, to check a receiver is set up.
+func pingWebhook(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	count, err := webhookCollection.CountDocuments(context.Background(), bson.M{"_id": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if count == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	id := primitive.NewObjectID().Hex()
+	payload, err := webhookPayload(id, "ping", fiber.Map{"webhookId": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return queueDelivery(c, WebhookDelivery{ID: id, WebhookID: objID, Event: "ping", Payload: payload})
+}
+
+// queueDelivery saves a delivery made by hand, to be sent straight away.
+func queueDelivery(c *fiber.Ctx, delivery WebhookDelivery) error {
+	delivery.Status = DeliveryPending
+	delivery.Attempts = []DeliveryAttempt{}
+	delivery.NextAttemptAt = time.Now()
+	delivery.CreatedAt = time.Now()
+
+	if _, err := webhookDeliveryCollection.InsertOne(context.Background(), delivery); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to queue delivery",
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(delivery)
+}
+
+// getWebhookDeliveries lists a webhook's deliveries, newest first,
+// optionally only those with the given status.
+func getWebhookDeliveries(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ID",
+		})
+	}
+
+	filter := bson.M{"webhookId": objID}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Limit must be between 1 and 1000",
+		})
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(int64(limit))
+	cursor, err := webhookDeliveryCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer cursor.Close(context.Background())
+
+	deliveries := []WebhookDelivery{}
+	if err := cursor.All(context.Background(), &deliveries); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error decoding delivery data",
+		})
+	}
+	return c.JSON(deliveries)
+}
+
+// replayDelivery sends a delivery's payload again as a new delivery, so
+// the original's attempts stay in the log as they were.
+func replayDelivery(c *fiber.Ctx) error {
+	var original WebhookDelivery
+	err := webhookDeliveryCollection.FindOne(context.Background(), bson.M{"_id": c.Params("id")}).Decode(&original)
+	if err == mongo.ErrNoDocuments {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Delivery not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return queueDelivery(c, WebhookDelivery{
+		ID:        primitive.NewObjectID().Hex(),
+		WebhookID: original.WebhookID,
+		Event:     original.Event,
+		Payload:   original.Payload,
+		ReplayOf:  original.ID,
+	})
+}
+
+// runWebhookReceive implements "webhook-receive", a receiver for trying
+// webhooks out locally: it prints each delivery and checks its signature.
+func runWebhookReceive(args []string) error {
+	flags := flag.NewFlagSet("webhook-receive", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:9000", "address to listen on")
+	secret := flags.String("secret", "", "webhook secret to check signatures with")
+	status := flags.Int("status", http.StatusOK, "status code to answer with, to try retries")
+	flags.Parse(args)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		verdict := "not checked"
+		if *secret != "" {
+			want := webhookSignature(*secret, r.Header.Get("X-Webhook-Timestamp"), body)
+			verdict = "valid"
+			if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Webhook-Signature"))) {
+				verdict = "INVALID"
+			}
+		}
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") != nil {
+			pretty.Reset()
+			pretty.Write(body)
+		}
+		fmt.Printf("%s %s delivery %s, signature %s\n%s\n\n",
+			time.Now().Format(time.RFC3339), r.Header.Get("X-Webhook-Event"),
+			r.Header.Get("X-Webhook-Delivery"), verdict, pretty.String())
+
+		if verdict == "INVALID" {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(*status)
+	})
+
+	fmt.Println("Listening for webhooks on", *addr)
+	return http.ListenAndServe(*addr, nil)
+}